@@ -7,12 +7,15 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/apiserver/pkg/authorization/authorizer"
 	"k8s.io/apiserver/pkg/endpoints/filters"
 	"k8s.io/kubernetes/pkg/util/slice"
 	"kubesphere.io/caddy-plugin/addmission/informer"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type Admission struct {
@@ -23,11 +26,52 @@ type Admission struct {
 type Rule struct {
 	Path         string
 	ExceptedPath []string
+	PolicyDir    string
+	DebugPath    string
+	SelfReview   bool
+	DevOps       bool
+	// NamespaceSelectors grant access in namespaces by label
+	NamespaceSelectors []NamespaceSelectorRule
+	// ListFilter are the resources, or *, whose denied lists are filtered to the items the user can get
+	ListFilter []string
+	// Mutating hooks label and annotate the objects of permitted create and update requests, before validation
+	Mutating []*MutatingHook
+	// Validating hooks admit the bodies of permitted create, update and patch requests
+	Validating []*ValidatingHook
+	// PolicySources hold expression policies
+	PolicySources []*PolicySource
+	// BreakGlass endpoints grant pre-approved cluster roles for a limited time
+	BreakGlass []*BreakGlass
+	// ClusterKubeconfig adds a member cluster per context of the kubeconfig file
+	ClusterKubeconfig string
+	// ClusterSecretNamespace and ClusterSecretSelector add a member cluster per kubeconfig Secret
+	ClusterSecretNamespace string
+	ClusterSecretSelector  string
+	// ClusterHeader selects the member cluster, as well as the /clusters/<name>/ path prefix
+	ClusterHeader string
+	// Client is the connection to the API server
+	Client informer.ClientConfig
 }
 
 func (c Admission) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 
-	if httpserver.Path(r.URL.Path).Matches(c.Rule.Path) {
+	if c.Rule.DebugPath != "" && httpserver.Path(r.URL.Path).Matches(c.Rule.DebugPath) {
+		return c.serveDebug(w, r)
+	}
+
+	for _, breakGlass := range c.Rule.BreakGlass {
+		if r.URL.Path == breakGlass.Path {
+			return breakGlass.serve(w, r)
+		}
+	}
+
+	if c.Rule.DevOps && isJenkinsPath(r.URL.Path) {
+		return c.serveDevOps(w, r)
+	}
+
+	clusterPath := c.Rule.clustersEnabled() && (isClusterPath(r.URL.Path) || (c.Rule.ClusterHeader != "" && r.Header.Get(c.Rule.ClusterHeader) != ""))
+
+	if clusterPath || httpserver.Path(r.URL.Path).Matches(c.Rule.Path) {
 
 		attrs, err := filters.GetAuthorizerAttributes(r.Context())
 
@@ -36,8 +80,26 @@ func (c Admission) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error
 			return c.Next.ServeHTTP(w, r)
 		}
 
+		if c.Rule.clustersEnabled() {
+			attrs, err = c.clusterRequest(r, attrs)
+
+			if isClusterUnavailable(err) {
+				return http.StatusServiceUnavailable, err
+			}
+
+			if err != nil {
+				return handleForbidden(w, err), nil
+			}
+		}
+
+		attrs = c.Rule.withRule(attrs)
+
+		if c.Rule.SelfReview && isSelfReview(attrs) {
+			return serveSelfReview(w, r, attrs)
+		}
+
 		for _, path := range c.Rule.ExceptedPath {
-			if httpserver.Path(r.URL.Path).Matches(path) {
+			if httpserver.Path(attrs.GetPath()).Matches(path) {
 				return c.Next.ServeHTTP(w, r)
 			}
 		}
@@ -48,10 +110,29 @@ func (c Admission) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error
 			return http.StatusInternalServerError, err
 		}
 
+		if !permitted && c.Rule.filtersList(attrs) {
+			return c.serveFilteredList(w, r, attrs)
+		}
+
 		if !permitted {
 			err = errors.NewForbidden(schema.GroupResource{Group: attrs.GetAPIGroup(), Resource: attrs.GetResource()}, attrs.GetName(), fmt.Errorf("permission undefined"))
 			return handleForbidden(w, err), nil
 		}
+
+		// only the mutating stage tells the upstream which patch it applied
+		r.Header.Del(admissionPatchHeader)
+
+		if len(c.Rule.Mutating) > 0 && isAdmissionRequest(attrs) {
+			if written, err := mutate(w, r, attrs, c.Rule.Mutating); written {
+				return 0, err
+			}
+		}
+
+		if len(c.Rule.Validating) > 0 && isAdmissionRequest(attrs) {
+			if written, err := validate(w, r, attrs, c.Rule.Validating); written {
+				return 0, err
+			}
+		}
 	}
 
 	return c.Next.ServeHTTP(w, r)
@@ -64,8 +145,23 @@ func handleForbidden(w http.ResponseWriter, err error) int {
 	return http.StatusForbidden
 }
 
+// Authorize evaluates attrs with the admission RBAC caches for other middlewares,
+// it fails when the admission directive has not started them
+func Authorize(attrs authorizer.Attributes) (bool, error) {
+
+	if !informer.Started() {
+		return false, fmt.Errorf("admission RBAC caches are not started")
+	}
+
+	return admissionValidate(attrs)
+}
+
 func admissionValidate(attrs authorizer.Attributes) (bool, error) {
 
+	if policyDecision(attrs, PolicyDeny) != nil {
+		return false, nil
+	}
+
 	if openAPIValidate(attrs) {
 		return true, nil
 	}
@@ -80,6 +176,18 @@ func admissionValidate(attrs authorizer.Attributes) (bool, error) {
 		return true, nil
 	}
 
+	if workspace := requestWorkspace(attrs); workspace != "" {
+		permitted, err = workspaceValidate(attrs, workspace)
+
+		if err != nil {
+			return false, err
+		}
+
+		if permitted {
+			return true, nil
+		}
+	}
+
 	if attrs.GetNamespace() != "" {
 		permitted, err = roleValidate(attrs)
 
@@ -90,42 +198,122 @@ func admissionValidate(attrs authorizer.Attributes) (bool, error) {
 		if permitted {
 			return true, nil
 		}
+
+		permitted, err = selectorValidate(attrs)
+
+		if err != nil {
+			return false, err
+		}
+
+		if permitted {
+			return true, nil
+		}
 	}
 
-	return false, nil
+	if policyDecision(attrs, PolicyAllow) != nil {
+		return true, nil
+	}
+
+	return breakGlassValidate(attrs)
 }
 
 func roleValidate(attrs authorizer.Attributes) (bool, error) {
 
-	roleBindings, err := informer.RoleBindingInformer.Lister().RoleBindings(attrs.GetNamespace()).List(labels.Everything())
+	roleBindings, err := namespacedBindings(listersFor(attrs), attrs.GetNamespace())
 
 	if err != nil {
 		return false, err
 	}
 
-	fullSource := attrs.GetResource()
+	return bindingsValidate(roleBindings, attrs)
+}
+
+func openAPIValidate(attrs authorizer.Attributes) bool {
+	_, ok := openAPIMatch(attrs)
+	return ok
+}
+
+// openAPIRule is an allowlist entry permitted to every authenticated user, or to the
+// members of the requested workspace, it matches either a request path or a combined resource
+type openAPIRule struct {
+	Path            string `json:"path,omitempty"`
+	Resource        string `json:"resource,omitempty"`
+	Verb            string `json:"verb"`
+	WorkspaceMember bool   `json:"workspaceMember,omitempty"`
+}
+
+var openAPIRules = []openAPIRule{
+	{Path: "/apis/account.kubesphere.io/v1alpha1/users/current", Verb: "get"},
+	{Path: "/apis/kubesphere.io/v1alpha1/workspaces", Verb: "list"},
+	{Resource: "rulesmapping", Verb: "get"},
+	{Resource: "workspaces/rules", Verb: "get", WorkspaceMember: true},
+	{Resource: "workspaces/roles", Verb: "get", WorkspaceMember: true},
+	{Resource: "workspaces/namespaces", Verb: "get", WorkspaceMember: true},
+	{Resource: "workspaces/devops", Verb: "get", WorkspaceMember: true},
+}
+
+func openAPIMatch(attrs authorizer.Attributes) (openAPIRule, bool) {
+
+	combinedResource := attrs.GetResource()
 
 	if attrs.GetSubresource() != "" {
-		fullSource = fullSource + "/" + attrs.GetSubresource()
+		combinedResource = combinedResource + "/" + attrs.GetSubresource()
 	}
 
-	for _, roleBinding := range roleBindings {
+	for _, rule := range openAPIRules {
 
-		for _, subj := range roleBinding.Subjects {
+		if rule.Verb != attrs.GetVerb() {
+			continue
+		}
 
-			if (subj.Kind == v1.UserKind && subj.Name == attrs.GetUser().GetName()) ||
-				(subj.Kind == v1.GroupKind && slice.ContainsString(attrs.GetUser().GetGroups(), subj.Name, nil)) {
-				role, err := informer.RoleInformer.Lister().Roles(attrs.GetNamespace()).Get(roleBinding.RoleRef.Name)
+		if rule.Path != "" && rule.Path == attrs.GetPath() {
+			return rule, true
+		}
 
-				if err != nil {
-					return false, err
+		if rule.Resource != "" && rule.Resource == combinedResource {
+			if rule.WorkspaceMember {
+				if member, err := isWorkspaceMember(listersFor(attrs), attrs.GetUser(), attrs.GetName()); err != nil || !member {
+					continue
 				}
+			}
+			return rule, true
+		}
+	}
+
+	return openAPIRule{}, false
+}
 
-				for _, rule := range role.Rules {
-					if ruleMatchesRequest(rule, attrs.GetAPIGroup(), "", attrs.GetResource(), attrs.GetSubresource(), attrs.GetName(), attrs.GetVerb()) {
-						return true, nil
-					}
+func clusterRoleValidate(attrs authorizer.Attributes) (bool, error) {
+
+	clusterRoleBindings, err := clusterBindings(listersFor(attrs))
+
+	if err != nil {
+		return false, err
+	}
+
+	return bindingsValidate(clusterRoleBindings, attrs)
+}
+
+func bindingsValidate(bindings []binding, attrs authorizer.Attributes) (bool, error) {
+
+	for _, binding := range bindings {
+
+		if !binding.appliesTo(attrs.GetUser()) {
+			continue
+		}
+
+		rules, err := binding.rules()
+
+		if err != nil {
+			return false, err
+		}
+
+		for _, rule := range rules {
+			if ruleAllows(rule, attrs) {
+				if binding.ExpiresAt != nil && binding.Kind != breakGlassKind {
+					recordExpiringBinding(binding, attrs)
 				}
+				return true, nil
 			}
 		}
 	}
@@ -133,84 +321,154 @@ func roleValidate(attrs authorizer.Attributes) (bool, error) {
 	return false, nil
 }
 
-func openAPIValidate(attrs authorizer.Attributes) bool {
+// expiresAtAnnotation on a ClusterRoleBinding or RoleBinding is the RFC 3339 time after which it is ignored
+const expiresAtAnnotation = "kubesphere.io/expires-at"
+
+// binding is a ClusterRoleBinding or a RoleBinding, a ClusterRoleBinding
+// of a workspace only applies inside the workspace
+type binding struct {
+	Kind      string       `json:"kind"`
+	Name      string       `json:"name"`
+	Namespace string       `json:"namespace,omitempty"`
+	Workspace string       `json:"workspace,omitempty"`
+	ExpiresAt *time.Time   `json:"expiresAt,omitempty"`
+	RoleRef   v1.RoleRef   `json:"roleRef"`
+	Subjects  []v1.Subject `json:"subjects"`
+	// Rules are granted directly by a namespace selector rule instead of a role
+	Rules []v1.PolicyRule `json:"rules,omitempty"`
+	// listers of the cluster the binding is in
+	listers *informer.Listers
+}
 
-	combinedResource := attrs.GetResource()
+func clusterBindings(listers *informer.Listers) ([]binding, error) {
 
-	if attrs.GetSubresource() != "" {
-		combinedResource = combinedResource + "/" + attrs.GetSubresource()
-	}
+	clusterRoleBindings, err := listers.ClusterRoleBindings.List(labels.Everything())
 
-	if attrs.GetPath() == "/apis/account.kubesphere.io/v1alpha1/users/current" && attrs.GetVerb() == "get" {
-		return true
+	if err != nil {
+		return nil, err
 	}
 
-	if attrs.GetPath() == "/apis/kubesphere.io/v1alpha1/workspaces" && attrs.GetVerb() == "list" {
-		return true
-	}
+	bindings := make([]binding, 0, len(clusterRoleBindings))
 
-	if combinedResource == "rulesmapping" && attrs.GetVerb() == "get" {
-		return true
+	for _, clusterRoleBinding := range clusterRoleBindings {
+		if _, ok := clusterRoleBinding.Labels[workspaceLabel]; ok {
+			continue
+		}
+		expiresAt, expired := bindingExpiry(clusterRoleBinding.Annotations)
+		if expired {
+			continue
+		}
+		bindings = append(bindings, binding{Kind: "ClusterRoleBinding", Name: clusterRoleBinding.Name, ExpiresAt: expiresAt, RoleRef: clusterRoleBinding.RoleRef, Subjects: clusterRoleBinding.Subjects, listers: listers})
 	}
 
-	if combinedResource == "workspaces/rules" && attrs.GetVerb() == "get" {
-		return true
+	return bindings, nil
+}
+
+// bindingExpiry reads the expires-at annotation, a binding past it or with an unreadable one is expired
+func bindingExpiry(annotations map[string]string) (*time.Time, bool) {
+
+	value, ok := annotations[expiresAtAnnotation]
+
+	if !ok {
+		return nil, false
 	}
 
-	if combinedResource == "workspaces/roles" && attrs.GetVerb() == "get" {
-		return true
+	expiresAt, err := time.Parse(time.RFC3339, value)
+
+	if err != nil {
+		return nil, true
 	}
 
-	if combinedResource == "workspaces/namespaces" && attrs.GetVerb() == "get" {
-		return true
+	return &expiresAt, time.Now().After(expiresAt)
+}
+
+func namespacedBindings(listers *informer.Listers, namespace string) ([]binding, error) {
+
+	roleBindings, err := listers.RoleBindings.RoleBindings(namespace).List(labels.Everything())
+
+	if err != nil {
+		return nil, err
 	}
 
-	if combinedResource == "workspaces/devops" && attrs.GetVerb() == "get" {
-		return true
+	bindings := make([]binding, 0, len(roleBindings))
+
+	for _, roleBinding := range roleBindings {
+		expiresAt, expired := bindingExpiry(roleBinding.Annotations)
+		if expired {
+			continue
+		}
+		bindings = append(bindings, binding{Kind: "RoleBinding", Name: roleBinding.Name, Namespace: roleBinding.Namespace, ExpiresAt: expiresAt, RoleRef: roleBinding.RoleRef, Subjects: roleBinding.Subjects, listers: listers})
 	}
 
-	return false
+	return bindings, nil
 }
 
-func clusterRoleValidate(attrs authorizer.Attributes) (bool, error) {
+// rules of the referenced role. As in Kubernetes RBAC a RoleBinding may refer to a ClusterRole,
+// whose rules are then granted in the namespace of the binding only.
+func (b binding) rules() ([]v1.PolicyRule, error) {
 
-	clusterRoleBindings, err := informer.ClusterRoleBindingInformer.Lister().List(labels.Everything())
+	if b.Rules != nil {
+		return b.Rules, nil
+	}
 
-	if err != nil {
-		return false, err
+	listers := b.listers
+
+	if listers == nil {
+		listers = informer.DefaultListers()
 	}
 
-	for _, clusterRoleBinding := range clusterRoleBindings {
+	if b.RoleRef.Kind == "ClusterRole" {
+		clusterRole, err := listers.ClusterRoles.Get(b.RoleRef.Name)
+
+		if err != nil {
+			return nil, err
+		}
 
-		for _, subject := range clusterRoleBinding.Subjects {
+		return clusterRole.Rules, nil
+	}
 
-			if (subject.Kind == v1.UserKind && subject.Name == attrs.GetUser().GetName()) ||
-				(subject.Kind == v1.GroupKind && hasString(attrs.GetUser().GetGroups(), subject.Name)) {
+	role, err := listers.Roles.Roles(b.Namespace).Get(b.RoleRef.Name)
 
-				clusterRole, err := informer.ClusterRoleInformer.Lister().Get(clusterRoleBinding.RoleRef.Name)
+	if err != nil {
+		return nil, err
+	}
 
-				if err != nil {
-					return false, err
-				}
+	return role.Rules, nil
+}
 
-				for _, rule := range clusterRole.Rules {
-					if attrs.IsResourceRequest() {
-						if ruleMatchesRequest(rule, attrs.GetAPIGroup(), "", attrs.GetResource(), attrs.GetSubresource(), attrs.GetName(), attrs.GetVerb()) {
-							return true, nil
-						}
-					} else {
-						if ruleMatchesRequest(rule, "", attrs.GetPath(), "", "", "", attrs.GetVerb()) {
-							return true, nil
-						}
-					}
+// appliesTo matches the user, group and service account subjects of the binding as Kubernetes
+// RBAC does, a service account subject without namespace is in the namespace of the binding
+func (b binding) appliesTo(usr user.Info) bool {
+	for _, subject := range b.Subjects {
+		if subjectMatches(subject, usr, b.Namespace) {
+			return true
+		}
+	}
+	return false
+}
 
-				}
+func subjectMatches(subject v1.Subject, usr user.Info, namespace string) bool {
 
-			}
+	switch subject.Kind {
+	case v1.UserKind:
+		return subject.Name == usr.GetName()
+	case v1.GroupKind:
+		return slice.ContainsString(usr.GetGroups(), subject.Name, nil)
+	case v1.ServiceAccountKind:
+		if subject.Namespace != "" {
+			namespace = subject.Namespace
 		}
+		return namespace != "" && usr.GetName() == serviceaccount.MakeUsername(namespace, subject.Name)
 	}
 
-	return false, nil
+	return false
+}
+
+func ruleAllows(rule v1.PolicyRule, attrs authorizer.Attributes) bool {
+	if attrs.IsResourceRequest() {
+		return ruleMatchesRequest(rule, attrs.GetAPIGroup(), "", attrs.GetResource(), attrs.GetSubresource(), attrs.GetName(), attrs.GetVerb())
+	}
+	return ruleMatchesRequest(rule, "", attrs.GetPath(), "", "", "", attrs.GetVerb())
 }
 
 func ruleMatchesResources(rule v1.PolicyRule, apiGroup string, resource string, subresource string, resourceName string) bool {
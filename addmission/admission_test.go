@@ -0,0 +1,116 @@
+package admission
+
+import (
+	"testing"
+
+	"k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	rbaclisters "k8s.io/client-go/listers/rbac/v1"
+	"k8s.io/client-go/tools/cache"
+	"kubesphere.io/caddy-plugin/addmission/informer"
+)
+
+// testListers caches the RBAC objects of a cluster
+func testListers(objects ...interface{}) *informer.Listers {
+
+	indexer := func() cache.Indexer {
+		return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	}
+
+	clusterRoleBindings, clusterRoles, roleBindings, roles := indexer(), indexer(), indexer(), indexer()
+
+	for _, object := range objects {
+		switch object.(type) {
+		case *v1.ClusterRoleBinding:
+			clusterRoleBindings.Add(object)
+		case *v1.ClusterRole:
+			clusterRoles.Add(object)
+		case *v1.RoleBinding:
+			roleBindings.Add(object)
+		case *v1.Role:
+			roles.Add(object)
+		}
+	}
+
+	return &informer.Listers{
+		ClusterRoleBindings: rbaclisters.NewClusterRoleBindingLister(clusterRoleBindings),
+		ClusterRoles:        rbaclisters.NewClusterRoleLister(clusterRoles),
+		RoleBindings:        rbaclisters.NewRoleBindingLister(roleBindings),
+		Roles:               rbaclisters.NewRoleLister(roles),
+	}
+}
+
+var podReader = []v1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}}
+
+func TestRoleBindings(t *testing.T) {
+
+	listers := testListers(
+		&v1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "pod-reader"}, Rules: podReader},
+		&v1.Role{ObjectMeta: metav1.ObjectMeta{Name: "pod-reader", Namespace: "demo"}},
+		&v1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "readers", Namespace: "demo"},
+			RoleRef:    v1.RoleRef{APIGroup: v1.GroupName, Kind: "ClusterRole", Name: "pod-reader"},
+			Subjects: []v1.Subject{
+				{Kind: v1.UserKind, APIGroup: v1.GroupName, Name: "alice"},
+				{Kind: v1.ServiceAccountKind, Name: "builder"},
+				{Kind: v1.ServiceAccountKind, Name: "deployer", Namespace: "ci"},
+			},
+		},
+		&v1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "monitoring"},
+			RoleRef:    v1.RoleRef{APIGroup: v1.GroupName, Kind: "ClusterRole", Name: "pod-reader"},
+			Subjects:   []v1.Subject{{Kind: v1.ServiceAccountKind, Name: "prometheus", Namespace: "monitoring"}},
+		},
+	)
+
+	tests := []struct {
+		name      string
+		user      string
+		namespace string
+		expected  bool
+	}{
+		// a ClusterRole referenced by a RoleBinding grants its rules, not those of the Role of the same name
+		{name: "cluster role of a role binding", user: "alice", namespace: "demo", expected: true},
+		{name: "only in the namespace of the binding", user: "alice", namespace: "other", expected: false},
+
+		// service account subjects
+		{name: "service account in the namespace of the binding", user: "system:serviceaccount:demo:builder", namespace: "demo", expected: true},
+		{name: "service account of another namespace", user: "system:serviceaccount:other:builder", namespace: "demo", expected: false},
+		{name: "service account with namespace", user: "system:serviceaccount:ci:deployer", namespace: "demo", expected: true},
+		{name: "service account of a cluster role binding", user: "system:serviceaccount:monitoring:prometheus", namespace: "other", expected: true},
+		{name: "user named like the service account", user: "prometheus", namespace: "other", expected: false},
+	}
+
+	for _, test := range tests {
+
+		attrs := requestAttributes{
+			Attributes: authorizer.AttributesRecord{
+				User:            &user.DefaultInfo{Name: test.user},
+				Verb:            "get",
+				Namespace:       test.namespace,
+				APIVersion:      "v1",
+				Resource:        "pods",
+				Name:            "web",
+				ResourceRequest: true,
+			},
+			listers: listers,
+		}
+
+		permitted, err := roleValidate(attrs)
+
+		if err == nil && !permitted {
+			permitted, err = clusterRoleValidate(attrs)
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if permitted != test.expected {
+			t.Errorf("%s: expected permitted %v but got %v", test.name, test.expected, permitted)
+		}
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
 	"kubesphere.io/caddy-plugin/addmission/informer"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func init() {
@@ -24,12 +26,24 @@ func Setup(c *caddy.Controller) error {
 		return err
 	}
 
-	err = informer.Start()
+	// objects other than RBAC manifests are only read from an API server
+	if rule.PolicyDir != "" && len(rule.Mutating) > 0 {
+		return fmt.Errorf("mutating hooks read stored objects from an API server and can not be used with policy_dir")
+	}
 
-	if err != nil {
+	// stops the informers and pollers of this configuration when Caddy shuts it down or reloads
+	stop := make(chan struct{})
+
+	if err := start(rule, stop); err != nil {
+		close(stop)
 		return err
 	}
 
+	c.OnShutdown(func() error {
+		close(stop)
+		return nil
+	})
+
 	c.OnStartup(func() error {
 		fmt.Println("Admission middleware is initiated")
 		return nil
@@ -41,10 +55,53 @@ func Setup(c *caddy.Controller) error {
 	return nil
 }
 
+// start runs the informers, cluster pollers and policy sources of rule until stop is closed
+func start(rule Rule, stop <-chan struct{}) error {
+
+	var err error
+
+	if rule.PolicyDir != "" {
+		err = informer.StartFromDirectory(rule.PolicyDir, stop)
+	} else {
+		err = informer.Start(rule.Client, stop)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if rule.ClusterKubeconfig != "" {
+		if err := informer.StartClustersFromKubeconfig(rule.ClusterKubeconfig, rule.Client, stop); err != nil {
+			return err
+		}
+	}
+
+	if rule.ClusterSecretNamespace != "" {
+		if err := informer.StartClustersFromSecrets(rule.ClusterSecretNamespace, rule.ClusterSecretSelector, rule.Client, stop); err != nil {
+			return err
+		}
+	}
+
+	for _, source := range rule.PolicySources {
+		if err := source.Start(stop); err != nil {
+			return fmt.Errorf("policies of %s: %v", source.Name, err)
+		}
+
+		if _, objects := source.current(); rule.PolicyDir != "" && len(objects) > 0 {
+			return fmt.Errorf("policies of %s read objects from an API server and can not be used with policy_dir", source.Name)
+		}
+	}
+
+	return nil
+}
+
 func parse(c *caddy.Controller) (Rule, error) {
 
 	rule := Rule{ExceptedPath: make([]string, 0)}
 
+	// ConfigMaps are read with the client options, which may follow them in the block
+	policyConfigMaps := make([]string, 0)
+
 	if c.Next() {
 		args := c.RemainingArgs()
 		switch len(args) {
@@ -78,6 +135,191 @@ func parse(c *caddy.Controller) (Rule, error) {
 						return rule, c.ArgErr()
 					}
 					break
+				case "policy_dir":
+					if !c.NextArg() {
+						return rule, c.ArgErr()
+					}
+
+					rule.PolicyDir = c.Val()
+
+					if c.NextArg() {
+						return rule, c.ArgErr()
+					}
+					break
+				case "debug_path":
+					if !c.NextArg() {
+						return rule, c.ArgErr()
+					}
+
+					rule.DebugPath = c.Val()
+
+					if c.NextArg() {
+						return rule, c.ArgErr()
+					}
+					break
+				case "self_review":
+					if c.NextArg() {
+						return rule, c.ArgErr()
+					}
+
+					rule.SelfReview = true
+					break
+				case "namespace_selector":
+					args := c.RemainingArgs()
+
+					if len(args) != 4 {
+						return rule, c.ArgErr()
+					}
+
+					selectorRule, err := NewNamespaceSelectorRule(args[0], args[1], args[2], args[3])
+
+					if err != nil {
+						return rule, c.Err(err.Error())
+					}
+
+					rule.NamespaceSelectors = append(rule.NamespaceSelectors, selectorRule)
+					break
+				case "list_filter":
+					rule.ListFilter = c.RemainingArgs()
+
+					if len(rule.ListFilter) == 0 {
+						rule.ListFilter = []string{"*"}
+					}
+					break
+				case "validate":
+					if !c.NextArg() {
+						return rule, c.ArgErr()
+					}
+
+					hook, err := NewValidatingCheck(c.Val(), c.RemainingArgs())
+
+					if err != nil {
+						return rule, c.Err(err.Error())
+					}
+
+					rule.Validating = append(rule.Validating, hook)
+					break
+				case "validate_webhook":
+					if !c.NextArg() {
+						return rule, c.ArgErr()
+					}
+
+					hook, err := NewValidatingWebhook(c.Val(), c.RemainingArgs())
+
+					if err != nil {
+						return rule, c.Err(err.Error())
+					}
+
+					rule.Validating = append(rule.Validating, hook)
+					break
+				case "mutate_label", "mutate_annotation":
+					field := MutateLabel
+
+					if c.Val() == "mutate_annotation" {
+						field = MutateAnnotation
+					}
+
+					args := c.RemainingArgs()
+
+					if len(args) < 2 {
+						return rule, c.ArgErr()
+					}
+
+					hook, err := NewMutatingHook(field, args[0], args[1], args[2:])
+
+					if err != nil {
+						return rule, c.Err(err.Error())
+					}
+
+					rule.Mutating = append(rule.Mutating, hook)
+					break
+				case "policy_file":
+					if !c.NextArg() {
+						return rule, c.ArgErr()
+					}
+
+					rule.PolicySources = append(rule.PolicySources, NewPolicyFile(c.Val()))
+
+					if c.NextArg() {
+						return rule, c.ArgErr()
+					}
+					break
+				case "policy_configmap":
+					if !c.NextArg() {
+						return rule, c.ArgErr()
+					}
+
+					policyConfigMaps = append(policyConfigMaps, c.Val())
+
+					if c.NextArg() {
+						return rule, c.ArgErr()
+					}
+					break
+				case "break_glass":
+					args := c.RemainingArgs()
+
+					if len(args) < 4 {
+						return rule, c.ArgErr()
+					}
+
+					maxDuration, err := time.ParseDuration(args[2])
+
+					if err != nil {
+						return rule, c.Err(err.Error())
+					}
+
+					breakGlass, err := NewBreakGlass(args[0], args[1], maxDuration, args[3:])
+
+					if err != nil {
+						return rule, c.Err(err.Error())
+					}
+
+					rule.BreakGlass = append(rule.BreakGlass, breakGlass)
+					break
+				case "clusters_kubeconfig":
+					if !c.NextArg() {
+						return rule, c.ArgErr()
+					}
+
+					rule.ClusterKubeconfig = c.Val()
+
+					if c.NextArg() {
+						return rule, c.ArgErr()
+					}
+					break
+				case "clusters_secrets":
+					args := c.RemainingArgs()
+
+					if len(args) != 2 {
+						return rule, c.ArgErr()
+					}
+
+					rule.ClusterSecretNamespace = args[0]
+					rule.ClusterSecretSelector = args[1]
+					break
+				case "cluster_header":
+					if !c.NextArg() {
+						return rule, c.ArgErr()
+					}
+
+					rule.ClusterHeader = c.Val()
+
+					if c.NextArg() {
+						return rule, c.ArgErr()
+					}
+					break
+				case "kubeconfig", "kube_context", "api_server", "ca_file", "token_file", "qps", "burst", "resync", "user_agent":
+					if err := ParseClientOption(c, &rule.Client); err != nil {
+						return rule, err
+					}
+					break
+				case "devops":
+					if c.NextArg() {
+						return rule, c.ArgErr()
+					}
+
+					rule.DevOps = true
+					break
 				}
 			}
 		case 1:
@@ -94,5 +336,72 @@ func parse(c *caddy.Controller) (Rule, error) {
 		return rule, c.ArgErr()
 	}
 
+	for _, configMap := range policyConfigMaps {
+		source, err := NewPolicyConfigMap(configMap, rule.Client)
+
+		if err != nil {
+			return rule, c.Err(err.Error())
+		}
+
+		rule.PolicySources = append(rule.PolicySources, source)
+	}
+
 	return rule, nil
 }
+
+// ParseClientOption parses an option of the connection to the API server
+func ParseClientOption(c *caddy.Controller, config *informer.ClientConfig) error {
+
+	option := c.Val()
+
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+
+	value := c.Val()
+
+	if c.NextArg() {
+		return c.ArgErr()
+	}
+
+	switch option {
+	case "kubeconfig":
+		config.Kubeconfig = value
+	case "kube_context":
+		config.Context = value
+	case "api_server":
+		config.Server = value
+	case "ca_file":
+		config.CAFile = value
+	case "token_file":
+		config.TokenFile = value
+	case "user_agent":
+		config.UserAgent = value
+	case "qps":
+		qps, err := strconv.ParseFloat(value, 32)
+
+		if err != nil || qps <= 0 {
+			return c.Errf("qps must be a positive number: %s", value)
+		}
+
+		config.QPS = float32(qps)
+	case "burst":
+		burst, err := strconv.Atoi(value)
+
+		if err != nil || burst <= 0 {
+			return c.Errf("burst must be a positive integer: %s", value)
+		}
+
+		config.Burst = burst
+	case "resync":
+		resync, err := time.ParseDuration(value)
+
+		if err != nil || resync <= 0 {
+			return c.Errf("resync must be a positive duration: %s", value)
+		}
+
+		config.Resync = resync
+	}
+
+	return nil
+}
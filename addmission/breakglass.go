@@ -0,0 +1,307 @@
+package admission
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/rbac/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"kubesphere.io/caddy-plugin/addmission/informer"
+)
+
+var (
+	breakGlassGrantsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "admission",
+		Name:      "break_glass_grants_total",
+		Help:      "Number of break-glass grants issued.",
+	}, []string{"role"})
+	breakGlassDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "admission",
+		Name:      "break_glass_decisions_total",
+		Help:      "Number of requests allowed only by a break-glass grant.",
+	}, []string{"role"})
+	expiringBindingDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "admission",
+		Name:      "expiring_binding_decisions_total",
+		Help:      "Number of requests allowed by a binding with an expires-at annotation.",
+	}, []string{"kind", "role"})
+)
+
+func init() {
+	prometheus.MustRegister(breakGlassGrantsTotal, breakGlassDecisions, expiringBindingDecisions)
+}
+
+// BreakGlass lets Subjects grant themselves ClusterRole in a cluster for at most MaxDuration
+// with a mandatory reason by POST to Path, e.g. ?minutes=30&reason=INC-1234&cluster=east, the
+// cluster of the gateway without cluster. GET lists the active grants and DELETE revokes the
+// grant of the caller in the cluster. Grants live in the memory of the site and only apply
+// to its requests in the granted cluster.
+type BreakGlass struct {
+	Path        string
+	ClusterRole string
+	MaxDuration time.Duration
+	Subjects    []v1.Subject
+
+	lock sync.Mutex
+	// active grants by cluster and user
+	grants map[string]*breakGlassGrant
+}
+
+// breakGlassKind is the kind of the binding of a break-glass grant
+const breakGlassKind = "BreakGlass"
+
+type breakGlassGrant struct {
+	User        string    `json:"user"`
+	Cluster     string    `json:"cluster,omitempty"`
+	ClusterRole string    `json:"clusterRole"`
+	Reason      string    `json:"reason"`
+	Granted     time.Time `json:"granted"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// NewBreakGlass parses subjects as user:<name>, group:<name> or serviceaccount:<namespace>:<name>
+func NewBreakGlass(path string, clusterRole string, maxDuration time.Duration, subjects []string) (*BreakGlass, error) {
+
+	if maxDuration <= 0 {
+		return nil, fmt.Errorf("break glass duration must be positive")
+	}
+
+	breakGlass := &BreakGlass{Path: path, ClusterRole: clusterRole, MaxDuration: maxDuration, grants: make(map[string]*breakGlassGrant)}
+
+	for _, subject := range subjects {
+		parsed, err := parseSubject(subject)
+
+		if err != nil {
+			return nil, err
+		}
+
+		breakGlass.Subjects = append(breakGlass.Subjects, parsed)
+	}
+
+	if len(breakGlass.Subjects) == 0 {
+		return nil, fmt.Errorf("break glass to %s needs the subjects allowed to use it", clusterRole)
+	}
+
+	return breakGlass, nil
+}
+
+func (b *BreakGlass) eligible(usr user.Info) bool {
+	for _, subject := range b.Subjects {
+		if subjectMatches(subject, usr, "") {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *BreakGlass) serve(w http.ResponseWriter, r *http.Request) (int, error) {
+
+	usr, ok := request.UserFrom(r.Context())
+
+	if !ok || !b.eligible(usr) {
+		return http.StatusForbidden, nil
+	}
+
+	cluster := r.URL.Query().Get("cluster")
+	key := cluster + "\x00" + usr.GetName()
+
+	switch r.Method {
+	case http.MethodGet:
+		return WriteJSON(w, http.StatusOK, b.activeGrants())
+	case http.MethodDelete:
+		b.lock.Lock()
+		grant, ok := b.grants[key]
+		delete(b.grants, key)
+		b.lock.Unlock()
+
+		if ok {
+			log.Printf("break-glass: user %q returned clusterrole %q%s granted for %q", grant.User, grant.ClusterRole, describeCluster(grant.Cluster), grant.Reason)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return http.StatusNoContent, nil
+	case http.MethodPost:
+	default:
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	if cluster != "" {
+		if _, ok := informer.Cluster(cluster); !ok {
+			return http.StatusBadRequest, fmt.Errorf("cluster %q not found", cluster)
+		}
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	reason := r.Form.Get("reason")
+
+	if reason == "" {
+		return http.StatusBadRequest, fmt.Errorf("break glass requires a reason")
+	}
+
+	minutes, err := strconv.Atoi(r.Form.Get("minutes"))
+
+	if err != nil || minutes <= 0 || time.Duration(minutes)*time.Minute > b.MaxDuration {
+		return http.StatusBadRequest, fmt.Errorf("break glass requires minutes between 1 and %d", int(b.MaxDuration/time.Minute))
+	}
+
+	now := time.Now()
+	grant := &breakGlassGrant{User: usr.GetName(), Cluster: cluster, ClusterRole: b.ClusterRole, Reason: reason, Granted: now, ExpiresAt: now.Add(time.Duration(minutes) * time.Minute)}
+
+	b.lock.Lock()
+	b.grants[key] = grant
+	b.lock.Unlock()
+
+	breakGlassGrantsTotal.WithLabelValues(b.ClusterRole).Inc()
+	log.Printf("break-glass: user %q granted clusterrole %q%s until %s for %q", grant.User, grant.ClusterRole, describeCluster(grant.Cluster), grant.ExpiresAt.Format(time.RFC3339), grant.Reason)
+
+	return WriteJSON(w, http.StatusCreated, grant)
+}
+
+// activeGrants drops the expired grants and lists the others
+func (b *BreakGlass) activeGrants() []*breakGlassGrant {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	grants := make([]*breakGlassGrant, 0)
+
+	for key, grant := range b.grants {
+		if now.After(grant.ExpiresAt) {
+			delete(b.grants, key)
+			continue
+		}
+		grants = append(grants, grant)
+	}
+
+	sort.Slice(grants, func(i, j int) bool { return grants[i].Granted.Before(grants[j].Granted) })
+
+	return grants
+}
+
+// activeGrant returns the grant of user in cluster unless it expired
+func (b *BreakGlass) activeGrant(cluster string, user string) (*breakGlassGrant, bool) {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	grant, ok := b.grants[cluster+"\x00"+user]
+
+	if !ok || time.Now().After(grant.ExpiresAt) {
+		return nil, false
+	}
+
+	return grant, true
+}
+
+// breakGlassValidate evaluates the active grants of the user in the cluster of the request on the
+// break-glass endpoints of its site, every request they allow is logged and counted
+func breakGlassValidate(attrs authorizer.Attributes) (bool, error) {
+
+	usr := attrs.GetUser()
+
+	if usr == nil {
+		return false, nil
+	}
+
+	for _, breakGlass := range breakGlassFor(attrs) {
+
+		grant, ok := breakGlass.activeGrant(clusterOf(attrs), usr.GetName())
+
+		if !ok {
+			continue
+		}
+
+		permitted, err := bindingsValidate([]binding{grant.binding(listersFor(attrs))}, attrs)
+
+		if err != nil {
+			return false, err
+		}
+
+		if permitted {
+			breakGlassDecisions.WithLabelValues(grant.ClusterRole).Inc()
+			log.Printf("break-glass: user %q allowed %s %s under clusterrole %q granted for %q",
+				grant.User, attrs.GetVerb(), describeRequest(attrs), grant.ClusterRole, grant.Reason)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// binding binds the clusterrole of the grant to its user in the cluster of listers
+func (grant *breakGlassGrant) binding(listers *informer.Listers) binding {
+	return binding{
+		Kind:      breakGlassKind,
+		Name:      grant.User,
+		ExpiresAt: &grant.ExpiresAt,
+		RoleRef:   v1.RoleRef{APIGroup: v1.GroupName, Kind: "ClusterRole", Name: grant.ClusterRole},
+		Subjects:  []v1.Subject{{Kind: v1.UserKind, APIGroup: v1.GroupName, Name: grant.User}},
+		listers:   listers,
+	}
+}
+
+// recordExpiringBinding logs and counts a request allowed by a binding with an expires-at annotation
+func recordExpiringBinding(b binding, attrs authorizer.Attributes) {
+
+	name := b.Name
+
+	if b.Namespace != "" {
+		name = b.Namespace + "/" + name
+	}
+
+	expiringBindingDecisions.WithLabelValues(b.Kind, b.RoleRef.Name).Inc()
+	log.Printf("expiring binding: user %q allowed %s %s under %s %q to %s %q until %s",
+		attrs.GetUser().GetName(), attrs.GetVerb(), describeRequest(attrs), b.Kind, name, strings.ToLower(b.RoleRef.Kind), b.RoleRef.Name, b.ExpiresAt.Format(time.RFC3339))
+}
+
+func describeCluster(cluster string) string {
+
+	if cluster == "" {
+		return ""
+	}
+
+	return " in cluster " + cluster
+}
+
+func describeRequest(attrs authorizer.Attributes) string {
+
+	if !attrs.IsResourceRequest() {
+		return attrs.GetPath() + describeCluster(clusterOf(attrs))
+	}
+
+	resource := attrs.GetResource()
+
+	if attrs.GetSubresource() != "" {
+		resource = resource + "/" + attrs.GetSubresource()
+	}
+
+	if attrs.GetAPIGroup() != "" {
+		resource = resource + "." + attrs.GetAPIGroup()
+	}
+
+	if attrs.GetName() != "" {
+		resource = resource + " " + attrs.GetName()
+	}
+
+	if attrs.GetNamespace() != "" {
+		resource = resource + " in " + attrs.GetNamespace()
+	}
+
+	return resource + describeCluster(clusterOf(attrs))
+}
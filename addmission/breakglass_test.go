@@ -0,0 +1,73 @@
+package admission
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+func TestBreakGlassValidate(t *testing.T) {
+
+	listers := testListers(&v1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "pod-reader"}, Rules: podReader})
+
+	breakGlass, err := NewBreakGlass("/break-glass", "pod-reader", time.Hour, []string{"user:alice", "user:bob"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	breakGlass.grants["east\x00alice"] = &breakGlassGrant{User: "alice", Cluster: "east", ClusterRole: "pod-reader", Reason: "INC-1", Granted: now, ExpiresAt: now.Add(time.Minute)}
+	breakGlass.grants["\x00bob"] = &breakGlassGrant{User: "bob", ClusterRole: "pod-reader", Reason: "INC-2", Granted: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)}
+
+	tests := []struct {
+		name       string
+		user       string
+		cluster    string
+		breakGlass []*BreakGlass
+		expected   bool
+	}{
+		{name: "granted cluster", user: "alice", cluster: "east", breakGlass: []*BreakGlass{breakGlass}, expected: true},
+		{name: "cluster of the gateway", user: "alice", breakGlass: []*BreakGlass{breakGlass}},
+		{name: "another cluster", user: "alice", cluster: "west", breakGlass: []*BreakGlass{breakGlass}},
+		{name: "another site", user: "alice", cluster: "east"},
+		{name: "another user", user: "carol", cluster: "east", breakGlass: []*BreakGlass{breakGlass}},
+		{name: "expired grant", user: "bob", breakGlass: []*BreakGlass{breakGlass}},
+	}
+
+	for _, test := range tests {
+
+		attrs := requestAttributes{
+			Attributes: authorizer.AttributesRecord{
+				User:            &user.DefaultInfo{Name: test.user},
+				Verb:            "get",
+				Namespace:       "demo",
+				APIVersion:      "v1",
+				Resource:        "pods",
+				ResourceRequest: true,
+			},
+			cluster:    test.cluster,
+			listers:    listers,
+			breakGlass: test.breakGlass,
+		}
+
+		permitted, err := breakGlassValidate(attrs)
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if permitted != test.expected {
+			t.Errorf("%s: expected permitted %v but got %v", test.name, test.expected, permitted)
+		}
+	}
+
+	if grants := breakGlass.activeGrants(); len(grants) != 1 || grants[0].User != "alice" {
+		t.Errorf("expected the active grant of alice but got %v", grants)
+	}
+}
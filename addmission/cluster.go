@@ -0,0 +1,211 @@
+package admission
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/endpoints/filters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"kubesphere.io/caddy-plugin/addmission/informer"
+)
+
+// clusterPathPrefix selects a member cluster by path, e.g. /clusters/east/api/v1/pods
+const clusterPathPrefix = "/clusters/"
+
+var clusterRequestInfoFactory = request.RequestInfoFactory{
+	APIPrefixes:          sets.NewString("api", "apis"),
+	GrouplessAPIPrefixes: sets.NewString("api")}
+
+// requestAttributes are the attributes of a request with the member cluster it is requested in,
+// if any, and the namespace selector rules, break-glass endpoints and policies of the site serving it
+type requestAttributes struct {
+	authorizer.Attributes
+	cluster    string
+	listers    *informer.Listers
+	selectors  []NamespaceSelectorRule
+	breakGlass []*BreakGlass
+	policies   []*PolicySource
+}
+
+// listersFor returns the caches of the cluster attrs are requested in
+func listersFor(attrs authorizer.Attributes) *informer.Listers {
+
+	if requestAttrs, ok := attrs.(requestAttributes); ok && requestAttrs.listers != nil {
+		return requestAttrs.listers
+	}
+
+	return informer.DefaultListers()
+}
+
+// clusterOf returns the member cluster attrs are requested in, empty for the cluster of the gateway
+func clusterOf(attrs authorizer.Attributes) string {
+
+	if requestAttrs, ok := attrs.(requestAttributes); ok {
+		return requestAttrs.cluster
+	}
+
+	return ""
+}
+
+// selectorRulesFor returns the namespace selector rules of the site attrs are requested on
+func selectorRulesFor(attrs authorizer.Attributes) []NamespaceSelectorRule {
+
+	if requestAttrs, ok := attrs.(requestAttributes); ok {
+		return requestAttrs.selectors
+	}
+
+	return nil
+}
+
+// breakGlassFor returns the break-glass endpoints of the site attrs are requested on
+func breakGlassFor(attrs authorizer.Attributes) []*BreakGlass {
+
+	if requestAttrs, ok := attrs.(requestAttributes); ok {
+		return requestAttrs.breakGlass
+	}
+
+	return nil
+}
+
+// policySourcesFor returns the policy sources of the site attrs are requested on
+func policySourcesFor(attrs authorizer.Attributes) []*PolicySource {
+
+	if requestAttrs, ok := attrs.(requestAttributes); ok {
+		return requestAttrs.policies
+	}
+
+	return nil
+}
+
+// withCluster requests derived, e.g. a review or list item check, in the cluster and with the
+// namespace selector rules of attrs
+func withCluster(attrs authorizer.Attributes, derived authorizer.Attributes) authorizer.Attributes {
+
+	if requestAttrs, ok := attrs.(requestAttributes); ok {
+		requestAttrs.Attributes = derived
+		return requestAttrs
+	}
+
+	return derived
+}
+
+// withRule evaluates attrs with the namespace selector rules, break-glass grants and policies of r
+func (r Rule) withRule(attrs authorizer.Attributes) authorizer.Attributes {
+
+	if len(r.NamespaceSelectors) == 0 && len(r.BreakGlass) == 0 && len(r.PolicySources) == 0 {
+		return attrs
+	}
+
+	requestAttrs, ok := attrs.(requestAttributes)
+
+	if !ok {
+		requestAttrs = requestAttributes{Attributes: attrs}
+	}
+
+	requestAttrs.selectors = r.NamespaceSelectors
+	requestAttrs.breakGlass = r.BreakGlass
+	requestAttrs.policies = r.PolicySources
+
+	return requestAttrs
+}
+
+func (r Rule) clustersEnabled() bool {
+	return r.ClusterKubeconfig != "" || r.ClusterSecretNamespace != ""
+}
+
+func isClusterPath(path string) bool {
+	return strings.HasPrefix(path, clusterPathPrefix)
+}
+
+// clusterRequest selects the member cluster of r by the cluster header or the path prefix.
+// A request selecting its cluster by header is rewritten to the prefixed path and the header
+// removed, so the cluster it is authorized in is the cluster it is routed to. The attributes of
+// a prefixed request are parsed again from the path below the prefix.
+func (c Admission) clusterRequest(r *http.Request, attrs authorizer.Attributes) (authorizer.Attributes, error) {
+
+	name := ""
+
+	if c.Rule.ClusterHeader != "" {
+		name = r.Header.Get(c.Rule.ClusterHeader)
+		r.Header.Del(c.Rule.ClusterHeader)
+	}
+
+	if name != "" && !isClusterPath(r.URL.Path) {
+
+		if strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid cluster %q", name)
+		}
+
+		r.URL.Path = clusterPathPrefix + name + r.URL.Path
+		r.URL.RawPath = ""
+	}
+
+	if isClusterPath(r.URL.Path) {
+
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, clusterPathPrefix), "/", 2)
+
+		if name != "" && name != parts[0] {
+			return nil, fmt.Errorf("cluster %q of the path does not match cluster %q of the header", parts[0], name)
+		}
+
+		name = parts[0]
+
+		clusterReq := new(http.Request)
+		*clusterReq = *r
+		clusterURL := *r.URL
+		clusterReq.URL = &clusterURL
+		clusterURL.Path = "/"
+
+		if len(parts) == 2 {
+			clusterURL.Path = "/" + parts[1]
+		}
+
+		requestInfo, err := clusterRequestInfoFactory.NewRequestInfo(clusterReq)
+
+		if err != nil {
+			return nil, err
+		}
+
+		derived, err := filters.GetAuthorizerAttributes(request.WithRequestInfo(r.Context(), requestInfo))
+
+		if err != nil {
+			return nil, err
+		}
+
+		attrs = derived
+	}
+
+	if name == "" {
+		return attrs, nil
+	}
+
+	listers, ok := informer.Cluster(name)
+
+	if !ok {
+		return nil, fmt.Errorf("cluster %q not found", name)
+	}
+
+	if !listers.Ready() {
+		return nil, &clusterUnavailableError{cluster: name}
+	}
+
+	return requestAttributes{Attributes: attrs, cluster: name, listers: listers}, nil
+}
+
+// clusterUnavailableError is a member cluster whose caches are not synced yet, which says
+// nothing about the request
+type clusterUnavailableError struct {
+	cluster string
+}
+
+func (e *clusterUnavailableError) Error() string {
+	return fmt.Sprintf("cluster %q is not ready", e.cluster)
+}
+
+func isClusterUnavailable(err error) bool {
+	_, ok := err.(*clusterUnavailableError)
+	return ok
+}
@@ -0,0 +1,219 @@
+package admission
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"kubesphere.io/caddy-plugin/addmission/informer"
+)
+
+const (
+	jenkinsAPIBase = "/apis/jenkins.kubesphere.io"
+	jenkinsJobPath = "/job/"
+	// Blue Ocean REST API of the pipelines of the Jenkins organization
+	blueOceanPath = "/blue/"
+	devopsGroup   = "devops.kubesphere.io"
+	// devopsProjectLabel on a Namespace names the DevOps project it holds, a project
+	// without a labelled namespace is held by the namespace of the same name
+	devopsProjectLabel = "kubesphere.io/devopsproject"
+)
+
+// Jenkins actions starting, stopping or answering a pipeline run
+var pipelineRunActions = []string{"build", "buildWithParameters", "rebuild", "replay", "stop", "term", "kill", "input", "abort"}
+
+// Jenkins actions changing a pipeline or the project folder
+var pipelineEditActions = []string{"config.xml", "configSubmit", "disable", "enable", "doRename", "confirmRename"}
+
+// isJenkinsPath matches every path proxied to Jenkins, the paths devopsAttributes does not map are denied
+func isJenkinsPath(path string) bool {
+	return path == jenkinsAPIBase || strings.HasPrefix(path, jenkinsAPIBase+"/") ||
+		strings.HasPrefix(path, jenkinsJobPath) || strings.HasPrefix(path, blueOceanPath)
+}
+
+// serveDevOps authorizes a Jenkins request against the roles of the DevOps project before forwarding it
+func (c Admission) serveDevOps(w http.ResponseWriter, r *http.Request) (int, error) {
+
+	usr, ok := request.UserFrom(r.Context())
+
+	// without auth info
+	if !ok {
+		return c.Next.ServeHTTP(w, r)
+	}
+
+	for _, path := range c.Rule.ExceptedPath {
+		if httpserver.Path(r.URL.Path).Matches(path) {
+			return c.Next.ServeHTTP(w, r)
+		}
+	}
+
+	attrs, ok := devopsAttributes(r, usr)
+
+	if !ok {
+		err := errors.NewForbidden(schema.GroupResource{Group: devopsGroup, Resource: "pipelines"}, "", fmt.Errorf("no DevOps project in %s", r.URL.Path))
+		return handleForbidden(w, err), nil
+	}
+
+	permitted, err := admissionValidate(c.Rule.withRule(attrs))
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if !permitted {
+		err = errors.NewForbidden(schema.GroupResource{Group: devopsGroup, Resource: attrs.GetResource()}, attrs.GetName(), fmt.Errorf("permission undefined in DevOps project namespace %s", attrs.GetNamespace()))
+		return handleForbidden(w, err), nil
+	}
+
+	return c.Next.ServeHTTP(w, r)
+}
+
+// devopsAttributes maps a Jenkins job request to the pipelines of the DevOps project owning
+// the top level job folder: viewing is get (list for the folder), running is create on
+// pipelines/runs, editing is update, create or delete on pipelines
+func devopsAttributes(r *http.Request, usr user.Info) (authorizer.AttributesRecord, bool) {
+
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, jenkinsAPIBase), "/"), "/")
+
+	if len(segments) >= 2 && segments[0] == "blue" {
+		return blueOceanAttributes(r, usr, segments)
+	}
+
+	if len(segments) < 2 || segments[0] != "job" || segments[1] == "" {
+		return authorizer.AttributesRecord{}, false
+	}
+
+	project := segments[1]
+	pipeline := ""
+	actions := segments[2:]
+
+	// multi-branch pipelines nest their branches as jobs of the pipeline
+	for len(actions) >= 2 && actions[0] == "job" {
+		if pipeline == "" {
+			pipeline = actions[1]
+		}
+		actions = actions[2:]
+	}
+
+	record := authorizer.AttributesRecord{
+		User:            usr,
+		ResourceRequest: true,
+		APIGroup:        devopsGroup,
+		APIVersion:      "v1alpha1",
+		Namespace:       devopsNamespace(project),
+		Resource:        "pipelines",
+		Name:            pipeline,
+		Path:            r.URL.Path,
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		record.Verb = "get"
+		if pipeline == "" {
+			record.Verb = "list"
+		}
+	case http.MethodDelete:
+		record.Verb = "delete"
+	default:
+		record.Verb = pipelineEditVerb(pipeline, actions)
+
+		for _, action := range actions {
+			if hasString(pipelineRunActions, action) {
+				record.Subresource = "runs"
+				record.Verb = "create"
+				break
+			}
+		}
+	}
+
+	return record, true
+}
+
+// blueOceanAttributes maps a Blue Ocean request under
+// /blue/rest/organizations/jenkins/pipelines/<project>/ like a job request: changing a run or
+// its steps is create on pipelines/runs
+func blueOceanAttributes(r *http.Request, usr user.Info, segments []string) (authorizer.AttributesRecord, bool) {
+
+	if len(segments) < 6 || segments[1] != "rest" || segments[2] != "organizations" || segments[4] != "pipelines" || segments[5] == "" {
+		return authorizer.AttributesRecord{}, false
+	}
+
+	project := segments[5]
+	pipeline := ""
+	actions := segments[6:]
+
+	// multi-branch pipelines nest their branches as branches of the pipeline
+	for len(actions) >= 2 && (actions[0] == "pipelines" || actions[0] == "branches") {
+		if pipeline == "" {
+			pipeline = actions[1]
+		}
+		actions = actions[2:]
+	}
+
+	record := authorizer.AttributesRecord{
+		User:            usr,
+		ResourceRequest: true,
+		APIGroup:        devopsGroup,
+		APIVersion:      "v1alpha1",
+		Namespace:       devopsNamespace(project),
+		Resource:        "pipelines",
+		Name:            pipeline,
+		Path:            r.URL.Path,
+	}
+
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		record.Verb = "get"
+		if pipeline == "" {
+			record.Verb = "list"
+		}
+	case len(actions) > 0 && (actions[0] == "runs" || actions[0] == "nodes" || actions[0] == "queue"):
+		record.Subresource = "runs"
+		record.Verb = "create"
+	case r.Method == http.MethodDelete:
+		record.Verb = "delete"
+	default:
+		record.Verb = "update"
+	}
+
+	return record, true
+}
+
+func pipelineEditVerb(pipeline string, actions []string) string {
+
+	for _, action := range actions {
+		switch {
+		case action == "doDelete" && pipeline != "" && len(actions) == 1:
+			return "delete"
+		case action == "createItem" && pipeline == "":
+			return "create"
+		case hasString(pipelineEditActions, action):
+			return "update"
+		}
+	}
+
+	return "update"
+}
+
+// devopsNamespace is the namespace holding project
+func devopsNamespace(project string) string {
+
+	if informer.NamespaceLister == nil {
+		return project
+	}
+
+	namespaces, err := informer.NamespaceLister.List(labels.SelectorFromSet(labels.Set{devopsProjectLabel: project}))
+
+	if err != nil || len(namespaces) == 0 {
+		return project
+	}
+
+	return namespaces[0].Name
+}
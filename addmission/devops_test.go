@@ -0,0 +1,68 @@
+package admission
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+func TestDevOpsAttributes(t *testing.T) {
+
+	const blue = "/apis/jenkins.kubesphere.io/blue/rest/organizations/jenkins/pipelines"
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		denied      bool
+		verb        string
+		pipeline    string
+		subresource string
+	}{
+		{name: "project folder", method: http.MethodGet, path: "/apis/jenkins.kubesphere.io/job/demo/", verb: "list"},
+		{name: "pipeline", method: http.MethodGet, path: "/job/demo/job/build/api/json", verb: "get", pipeline: "build"},
+		{name: "run a pipeline", method: http.MethodPost, path: "/job/demo/job/build/build", verb: "create", pipeline: "build", subresource: "runs"},
+		{name: "edit a pipeline", method: http.MethodPost, path: "/job/demo/job/build/config.xml", verb: "update", pipeline: "build"},
+
+		{name: "blue ocean project", method: http.MethodGet, path: blue + "/demo/", verb: "list"},
+		{name: "blue ocean branch", method: http.MethodGet, path: blue + "/demo/pipelines/build/branches/master/runs/", verb: "get", pipeline: "build"},
+		{name: "blue ocean run", method: http.MethodPost, path: blue + "/demo/pipelines/build/branches/master/runs/", verb: "create", pipeline: "build", subresource: "runs"},
+		{name: "blue ocean stop", method: http.MethodPut, path: "/blue/rest/organizations/jenkins/pipelines/demo/pipelines/build/runs/1/stop/", verb: "create", pipeline: "build", subresource: "runs"},
+		{name: "blue ocean delete", method: http.MethodDelete, path: blue + "/demo/pipelines/build/", verb: "delete", pipeline: "build"},
+
+		// Jenkins paths outside the DevOps projects
+		{name: "jenkins root", method: http.MethodGet, path: "/apis/jenkins.kubesphere.io/api/json", denied: true},
+		{name: "script console", method: http.MethodPost, path: "/apis/jenkins.kubesphere.io/script", denied: true},
+		{name: "blue ocean search", method: http.MethodGet, path: "/blue/rest/search/", denied: true},
+		{name: "blue ocean pipelines", method: http.MethodGet, path: blue + "/", denied: true},
+	}
+
+	for _, test := range tests {
+
+		if !isJenkinsPath(test.path) {
+			t.Errorf("%s: expected %s to be a Jenkins path", test.name, test.path)
+			continue
+		}
+
+		record, ok := devopsAttributes(httptest.NewRequest(test.method, test.path, nil), &user.DefaultInfo{Name: "alice"})
+
+		if ok == test.denied {
+			t.Errorf("%s: expected denied %v but got %v", test.name, test.denied, !ok)
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		if record.Namespace != "demo" || record.Verb != test.verb || record.Name != test.pipeline || record.Subresource != test.subresource {
+			t.Errorf("%s: expected %s %s/%s in demo but got %s %s/%s in %s", test.name, test.verb, test.pipeline, test.subresource, record.Verb, record.Name, record.Subresource, record.Namespace)
+		}
+	}
+
+	if isJenkinsPath("/apis/jenkins.kubesphere.io.example/job/demo") {
+		t.Errorf("expected another API group not to be a Jenkins path")
+	}
+}
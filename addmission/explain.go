@@ -0,0 +1,333 @@
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"kubesphere.io/caddy-plugin/addmission/informer"
+)
+
+const (
+	explainEndpoint = "/explain"
+	whoCanEndpoint  = "/who-can"
+)
+
+// explanation is the decision for a request together with the policy it was derived from
+type explanation struct {
+	Allowed    bool              `json:"allowed"`
+	Allowlist  *openAPIRule      `json:"allowlist,omitempty"`
+	Policy     *ExpressionPolicy `json:"policy,omitempty"`
+	Matched    []bindingMatch    `json:"matched,omitempty"`
+	NearMisses []bindingMatch    `json:"nearMisses,omitempty"`
+	Errors     []string          `json:"errors,omitempty"`
+}
+
+type bindingMatch struct {
+	binding
+	Rules  []v1.PolicyRule `json:"rules,omitempty"`
+	Reason string          `json:"reason"`
+}
+
+// subjects allowed to perform a request
+type whoCanResult struct {
+	Allowlist       *openAPIRule `json:"allowlist,omitempty"`
+	Users           []string     `json:"users"`
+	Groups          []string     `json:"groups"`
+	ServiceAccounts []string     `json:"serviceAccounts"`
+	Bindings        []binding    `json:"bindings"`
+	Errors          []string     `json:"errors,omitempty"`
+}
+
+// serveDebug answers explain and who-can queries below the debug path. The caller must be
+// granted the debug path as a non-resource URL, e.g. by cluster-admin.
+func (c Admission) serveDebug(w http.ResponseWriter, r *http.Request) (int, error) {
+
+	usr, ok := request.UserFrom(r.Context())
+
+	if !ok {
+		return http.StatusUnauthorized, nil
+	}
+
+	permitted, err := admissionValidate(authorizer.AttributesRecord{User: usr, Verb: strings.ToLower(r.Method), Path: r.URL.Path})
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if !permitted {
+		err = errors.NewForbidden(schema.GroupResource{}, "", fmt.Errorf("user %q cannot access %s", usr.GetName(), r.URL.Path))
+		return handleForbidden(w, err), nil
+	}
+
+	record, err := attributesFromQuery(r.URL.Query())
+
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	var attrs authorizer.Attributes = record
+
+	if cluster := r.URL.Query().Get("cluster"); cluster != "" {
+		listers, ok := informer.Cluster(cluster)
+
+		if !ok {
+			return http.StatusNotFound, fmt.Errorf("cluster %q not found", cluster)
+		}
+
+		if !listers.Ready() {
+			return http.StatusServiceUnavailable, &clusterUnavailableError{cluster: cluster}
+		}
+
+		attrs = requestAttributes{Attributes: record, cluster: cluster, listers: listers}
+	}
+
+	attrs = c.Rule.withRule(attrs)
+
+	switch strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(c.Rule.DebugPath, "/")) {
+	case explainEndpoint:
+		if record.User.GetName() == "" && len(record.User.GetGroups()) == 0 {
+			return http.StatusBadRequest, fmt.Errorf("user or groups required")
+		}
+		return WriteJSON(w, http.StatusOK, explain(attrs))
+	case whoCanEndpoint:
+		return WriteJSON(w, http.StatusOK, whoCan(attrs))
+	default:
+		return http.StatusNotFound, nil
+	}
+}
+
+// attributesFromQuery reads user, groups, verb, apiGroup, resource, subresource, namespace, name and path,
+// path selects a non-resource request. The cluster parameter selects a member cluster.
+func attributesFromQuery(query url.Values) (authorizer.AttributesRecord, error) {
+
+	usr := &user.DefaultInfo{Name: query.Get("user")}
+
+	if groups := query.Get("groups"); groups != "" {
+		for _, group := range strings.Split(groups, ",") {
+			usr.Groups = append(usr.Groups, strings.TrimSpace(group))
+		}
+	}
+
+	attrs := authorizer.AttributesRecord{
+		User:            usr,
+		Verb:            query.Get("verb"),
+		APIGroup:        query.Get("apiGroup"),
+		Resource:        query.Get("resource"),
+		Subresource:     query.Get("subresource"),
+		Namespace:       query.Get("namespace"),
+		Name:            query.Get("name"),
+		Path:            query.Get("path"),
+		ResourceRequest: query.Get("path") == "",
+	}
+
+	if attrs.Verb == "" {
+		return attrs, fmt.Errorf("verb required")
+	}
+
+	if attrs.ResourceRequest && attrs.Resource == "" {
+		return attrs, fmt.Errorf("resource or path required")
+	}
+
+	return attrs, nil
+}
+
+func explain(attrs authorizer.Attributes) *explanation {
+
+	result := &explanation{}
+
+	if rule, ok := openAPIMatch(attrs); ok {
+		result.Allowed = true
+		result.Allowlist = &rule
+	}
+
+	bindings, errs := applicableBindings(attrs, attrs.GetNamespace(), requestWorkspace(attrs))
+	result.Errors = errs
+
+	for _, binding := range bindings {
+
+		subjectMatched := binding.appliesTo(attrs.GetUser())
+
+		rules, err := binding.rules()
+
+		if err != nil {
+			if subjectMatched {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s %s: %v", binding.Kind, binding.Name, err))
+			}
+			continue
+		}
+
+		granting := make([]v1.PolicyRule, 0)
+
+		for _, rule := range rules {
+			if ruleAllows(rule, attrs) {
+				granting = append(granting, rule)
+			}
+		}
+
+		switch {
+		case subjectMatched && len(granting) > 0:
+			result.Allowed = true
+			result.Matched = append(result.Matched, bindingMatch{binding: binding, Rules: granting, Reason: "subject and rule match"})
+		case subjectMatched:
+			result.NearMisses = append(result.NearMisses, bindingMatch{binding: binding, Rules: rules,
+				Reason: fmt.Sprintf("subject matches but no rule of %s %s grants the request", binding.RoleRef.Kind, binding.RoleRef.Name)})
+		case len(granting) > 0:
+			result.NearMisses = append(result.NearMisses, bindingMatch{binding: binding, Rules: granting,
+				Reason: fmt.Sprintf("%s %s grants the request but no subject matches the user", binding.RoleRef.Kind, binding.RoleRef.Name)})
+		}
+	}
+
+	if policy := policyDecision(attrs, PolicyDeny); policy != nil {
+		result.Allowed = false
+		result.Policy = policy
+	} else if !result.Allowed {
+		if policy := policyDecision(attrs, PolicyAllow); policy != nil {
+			result.Allowed = true
+			result.Policy = policy
+		}
+	}
+
+	return result
+}
+
+func whoCan(attrs authorizer.Attributes) *whoCanResult {
+
+	result := &whoCanResult{Users: []string{}, Groups: []string{}, ServiceAccounts: []string{}, Bindings: []binding{}}
+
+	if rule, ok := openAPIMatch(attrs); ok {
+		result.Allowlist = &rule
+	}
+
+	bindings, errs := applicableBindings(attrs, attrs.GetNamespace(), requestWorkspace(attrs))
+	result.Errors = errs
+
+	users := make(map[string]bool)
+	groups := make(map[string]bool)
+	serviceAccounts := make(map[string]bool)
+
+	for _, binding := range bindings {
+
+		rules, err := binding.rules()
+
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s %s: %v", binding.Kind, binding.Name, err))
+			continue
+		}
+
+		granted := false
+
+		for _, rule := range rules {
+			if ruleAllows(rule, attrs) {
+				granted = true
+				break
+			}
+		}
+
+		if !granted {
+			continue
+		}
+
+		result.Bindings = append(result.Bindings, binding)
+
+		for _, subject := range binding.Subjects {
+			switch subject.Kind {
+			case v1.UserKind:
+				users[subject.Name] = true
+			case v1.GroupKind:
+				groups[subject.Name] = true
+			case v1.ServiceAccountKind:
+				namespace := subject.Namespace
+				if namespace == "" {
+					namespace = binding.Namespace
+				}
+				serviceAccounts[namespace+"/"+subject.Name] = true
+			}
+		}
+	}
+
+	result.Users = sortedKeys(users)
+	result.Groups = sortedKeys(groups)
+	result.ServiceAccounts = sortedKeys(serviceAccounts)
+
+	return result
+}
+
+// applicableBindings lists the cluster bindings, the bindings of the workspace and, for
+// namespaced requests, the bindings and namespace selector rules in the namespace, in the
+// cluster and with the selector rules of attrs
+func applicableBindings(attrs authorizer.Attributes, namespace string, workspace string) ([]binding, []string) {
+
+	errs := make([]string, 0)
+	listers := listersFor(attrs)
+
+	bindings, err := clusterBindings(listers)
+
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if workspace != "" {
+		workspaceRoleBindings, err := workspaceBindings(listers, workspace)
+
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+
+		bindings = append(bindings, workspaceRoleBindings...)
+	}
+
+	if namespace != "" {
+		roleBindings, err := namespacedBindings(listers, namespace)
+
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+
+		bindings = append(bindings, roleBindings...)
+
+		selected, err := selectorBindings(listers, selectorRulesFor(attrs), namespace)
+
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+
+		bindings = append(bindings, selected...)
+	}
+
+	return bindings, errs
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteJSON writes v indented with code, also used by the auth middleware
+func WriteJSON(w http.ResponseWriter, code int, v interface{}) (int, error) {
+
+	data, err := json.MarshalIndent(v, "", "  ")
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+
+	return code, nil
+}
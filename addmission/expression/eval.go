@@ -0,0 +1,656 @@
+package expression
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Vars are the values of the variables of an expression
+type Vars map[string]interface{}
+
+type node interface {
+	eval(vars Vars) (interface{}, error)
+}
+
+// Eval evaluates the expression with vars
+func (e *Expression) Eval(vars Vars) (interface{}, error) {
+	return e.root.eval(vars)
+}
+
+// EvalBool evaluates an expression that has to be a bool
+func (e *Expression) EvalBool(vars Vars) (bool, error) {
+
+	value, err := e.root.eval(vars)
+
+	if err != nil {
+		return false, err
+	}
+
+	result, ok := value.(bool)
+
+	if !ok {
+		return false, fmt.Errorf("%s is %s, not a bool", e.source, typeName(value))
+	}
+
+	return result, nil
+}
+
+// Normalize converts v to the values of the language: string slices and maps, other
+// integer types and structs via their JSON form are not expected and left as they are
+func Normalize(v interface{}) interface{} {
+
+	switch value := v.(type) {
+	case int:
+		return int64(value)
+	case int32:
+		return int64(value)
+	case float32:
+		return float64(value)
+	case []string:
+		items := make([]interface{}, len(value))
+		for i, item := range value {
+			items[i] = item
+		}
+		return items
+	case []interface{}:
+		items := make([]interface{}, len(value))
+		for i, item := range value {
+			items[i] = Normalize(item)
+		}
+		return items
+	case map[string]string:
+		fields := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			fields[key] = item
+		}
+		return fields
+	case map[string][]string:
+		fields := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			fields[key] = Normalize(item)
+		}
+		return fields
+	case map[string]interface{}:
+		fields := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			fields[key] = Normalize(item)
+		}
+		return fields
+	}
+
+	return v
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (l *literal) eval(vars Vars) (interface{}, error) {
+	return l.value, nil
+}
+
+type variable struct {
+	name string
+}
+
+func (v *variable) eval(vars Vars) (interface{}, error) {
+
+	value, ok := vars[v.name]
+
+	if !ok {
+		return nil, fmt.Errorf("undefined variable %s", v.name)
+	}
+
+	return value, nil
+}
+
+type list struct {
+	items []node
+}
+
+func (l *list) eval(vars Vars) (interface{}, error) {
+
+	items := make([]interface{}, 0, len(l.items))
+
+	for _, item := range l.items {
+		value, err := item.eval(vars)
+
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, value)
+	}
+
+	return items, nil
+}
+
+type member struct {
+	target node
+	name   string
+}
+
+func (m *member) eval(vars Vars) (interface{}, error) {
+
+	target, err := m.target.eval(vars)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch value := target.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return value[m.name], nil
+	}
+
+	return nil, fmt.Errorf("%s has no member %s", typeName(target), m.name)
+}
+
+type index struct {
+	target node
+	key    node
+}
+
+func (i *index) eval(vars Vars) (interface{}, error) {
+
+	target, err := i.target.eval(vars)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := i.key.eval(vars)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch value := target.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		name, ok := key.(string)
+
+		if !ok {
+			return nil, fmt.Errorf("map index is %s, not a string", typeName(key))
+		}
+
+		return value[name], nil
+	case []interface{}:
+		position, ok := key.(int64)
+
+		if !ok {
+			return nil, fmt.Errorf("list index is %s, not an int", typeName(key))
+		}
+
+		if position < 0 || position >= int64(len(value)) {
+			return nil, fmt.Errorf("list index %d out of range [0, %d)", position, len(value))
+		}
+
+		return value[position], nil
+	}
+
+	return nil, fmt.Errorf("%s can not be indexed", typeName(target))
+}
+
+type unary struct {
+	operator string
+	operand  node
+}
+
+func (u *unary) eval(vars Vars) (interface{}, error) {
+
+	operand, err := u.operand.eval(vars)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch value := operand.(type) {
+	case bool:
+		if u.operator == "!" {
+			return !value, nil
+		}
+	case int64:
+		if u.operator == "-" {
+			return -value, nil
+		}
+	case float64:
+		if u.operator == "-" {
+			return -value, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s is not defined on %s", u.operator, typeName(operand))
+}
+
+type conditional struct {
+	condition node
+	then      node
+	otherwise node
+}
+
+func (c *conditional) eval(vars Vars) (interface{}, error) {
+
+	condition, err := evalBool(c.condition, vars, "?:")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if condition {
+		return c.then.eval(vars)
+	}
+
+	return c.otherwise.eval(vars)
+}
+
+type binary struct {
+	operator string
+	left     node
+	right    node
+}
+
+func (b *binary) eval(vars Vars) (interface{}, error) {
+
+	// short circuit
+	switch b.operator {
+	case "&&", "||":
+		left, err := evalBool(b.left, vars, b.operator)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if left == (b.operator == "||") {
+			return left, nil
+		}
+
+		return evalBool(b.right, vars, b.operator)
+	}
+
+	left, err := b.left.eval(vars)
+
+	if err != nil {
+		return nil, err
+	}
+
+	right, err := b.right.eval(vars)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch b.operator {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "in":
+		switch container := right.(type) {
+		case []interface{}:
+			for _, item := range container {
+				if equal(left, item) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			key, ok := left.(string)
+			if !ok {
+				return false, nil
+			}
+			_, found := container[key]
+			return found, nil
+		case nil:
+			return false, nil
+		}
+		return nil, fmt.Errorf("in is not defined on %s", typeName(right))
+	case "<", "<=", ">", ">=":
+		return compare(b.operator, left, right)
+	}
+
+	return arithmetic(b.operator, left, right)
+}
+
+func evalBool(n node, vars Vars, operator string) (bool, error) {
+
+	value, err := n.eval(vars)
+
+	if err != nil {
+		return false, err
+	}
+
+	result, ok := value.(bool)
+
+	if !ok {
+		return false, fmt.Errorf("%s is not defined on %s", operator, typeName(value))
+	}
+
+	return result, nil
+}
+
+func equal(left, right interface{}) bool {
+
+	if l, r, ok := numbers(left, right); ok {
+		return l == r
+	}
+
+	return reflect.DeepEqual(left, right)
+}
+
+// numbers converts a pair of numbers, mixing int64 and float64, to float64
+func numbers(left, right interface{}) (float64, float64, bool) {
+
+	toFloat := func(v interface{}) (float64, bool) {
+		switch value := v.(type) {
+		case int64:
+			return float64(value), true
+		case float64:
+			return value, true
+		}
+		return 0, false
+	}
+
+	l, lok := toFloat(left)
+	r, rok := toFloat(right)
+
+	return l, r, lok && rok
+}
+
+func compare(operator string, left, right interface{}) (interface{}, error) {
+
+	var order int
+
+	if l, r, ok := numbers(left, right); ok {
+		switch {
+		case l < r:
+			order = -1
+		case l > r:
+			order = 1
+		}
+	} else if l, ok := left.(string); ok {
+		r, ok := right.(string)
+
+		if !ok {
+			return nil, fmt.Errorf("%s is not defined on string and %s", operator, typeName(right))
+		}
+
+		order = strings.Compare(l, r)
+	} else {
+		return nil, fmt.Errorf("%s is not defined on %s and %s", operator, typeName(left), typeName(right))
+	}
+
+	switch operator {
+	case "<":
+		return order < 0, nil
+	case "<=":
+		return order <= 0, nil
+	case ">":
+		return order > 0, nil
+	}
+
+	return order >= 0, nil
+}
+
+func arithmetic(operator string, left, right interface{}) (interface{}, error) {
+
+	if l, ok := left.(int64); ok {
+		if r, ok := right.(int64); ok {
+			switch operator {
+			case "+":
+				return l + r, nil
+			case "-":
+				return l - r, nil
+			case "*":
+				return l * r, nil
+			case "/", "%":
+				if r == 0 {
+					return nil, fmt.Errorf("division by zero")
+				}
+				if operator == "/" {
+					return l / r, nil
+				}
+				return l % r, nil
+			}
+		}
+	}
+
+	if l, r, ok := numbers(left, right); ok {
+		switch operator {
+		case "+":
+			return l + r, nil
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		case "/":
+			return l / r, nil
+		}
+	}
+
+	if operator == "+" {
+		switch l := left.(type) {
+		case string:
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		case []interface{}:
+			if r, ok := right.([]interface{}); ok {
+				return append(append(make([]interface{}, 0, len(l)+len(r)), l...), r...), nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%s is not defined on %s and %s", operator, typeName(left), typeName(right))
+}
+
+type function struct {
+	name string
+	args []node
+}
+
+func (f *function) eval(vars Vars) (interface{}, error) {
+
+	arg, err := f.args[0].eval(vars)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch f.name {
+	case "has":
+		return arg != nil, nil
+	case "size":
+		return size(arg)
+	case "int":
+		switch value := arg.(type) {
+		case int64:
+			return value, nil
+		case float64:
+			return int64(value), nil
+		case string:
+			return strconv.ParseInt(value, 10, 64)
+		}
+	case "string":
+		switch value := arg.(type) {
+		case string:
+			return value, nil
+		case int64:
+			return strconv.FormatInt(value, 10), nil
+		case float64:
+			return strconv.FormatFloat(value, 'g', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(value), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s is not defined on %s", f.name, typeName(arg))
+}
+
+func size(v interface{}) (interface{}, error) {
+
+	switch value := v.(type) {
+	case string:
+		return int64(len(value)), nil
+	case []interface{}:
+		return int64(len(value)), nil
+	case map[string]interface{}:
+		return int64(len(value)), nil
+	case nil:
+		return int64(0), nil
+	}
+
+	return nil, fmt.Errorf("size is not defined on %s", typeName(v))
+}
+
+type method struct {
+	target  node
+	name    string
+	args    []node
+	pattern *regexp.Regexp
+}
+
+func (m *method) eval(vars Vars) (interface{}, error) {
+
+	target, err := m.target.eval(vars)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch m.name {
+	case "size":
+		return size(target)
+	case "exists", "all":
+		return m.quantify(target, vars)
+	}
+
+	args := make([]interface{}, 0, len(m.args))
+
+	for _, arg := range m.args {
+		value, err := arg.eval(vars)
+
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, value)
+	}
+
+	if items, ok := target.([]interface{}); ok && m.name == "contains" {
+		for _, item := range items {
+			if equal(item, args[0]) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	text, ok := target.(string)
+
+	if !ok {
+		if target == nil && m.name != "lower" && m.name != "upper" {
+			return false, nil
+		}
+		return nil, fmt.Errorf("%s is not defined on %s", m.name, typeName(target))
+	}
+
+	switch m.name {
+	case "lower":
+		return strings.ToLower(text), nil
+	case "upper":
+		return strings.ToUpper(text), nil
+	}
+
+	arg, ok := args[0].(string)
+
+	if !ok {
+		return nil, fmt.Errorf("%s takes a string, not %s", m.name, typeName(args[0]))
+	}
+
+	switch m.name {
+	case "startsWith":
+		return strings.HasPrefix(text, arg), nil
+	case "endsWith":
+		return strings.HasSuffix(text, arg), nil
+	case "contains":
+		return strings.Contains(text, arg), nil
+	}
+
+	pattern := m.pattern
+
+	if pattern == nil {
+		if pattern, err = regexp.Compile(arg); err != nil {
+			return nil, err
+		}
+	}
+
+	return pattern.MatchString(text), nil
+}
+
+// quantify evaluates the predicate of exists and all with the variable bound to each list item or map key
+func (m *method) quantify(target interface{}, vars Vars) (interface{}, error) {
+
+	items := make([]interface{}, 0)
+
+	switch value := target.(type) {
+	case nil:
+	case []interface{}:
+		items = value
+	case map[string]interface{}:
+		for key := range value {
+			items = append(items, key)
+		}
+	default:
+		return nil, fmt.Errorf("%s is not defined on %s", m.name, typeName(target))
+	}
+
+	name := m.args[0].(*variable).name
+	scope := make(Vars, len(vars)+1)
+
+	for key, value := range vars {
+		scope[key] = value
+	}
+
+	for _, item := range items {
+		scope[name] = item
+
+		result, err := evalBool(m.args[1], scope, m.name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if result == (m.name == "exists") {
+			return result, nil
+		}
+	}
+
+	return m.name == "all", nil
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
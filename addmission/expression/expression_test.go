@@ -0,0 +1,210 @@
+package expression
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseErrors(t *testing.T) {
+
+	tests := []struct {
+		src string
+		err string
+	}{
+		{src: "", err: "unexpected end of expression"},
+		{src: "1 +", err: "unexpected end of expression"},
+		{src: "(1 + 2", err: "expected ) at 6"},
+		{src: "[1, 2", err: "expected ] at 5"},
+		{src: "a[0", err: "expected ] at 3"},
+		{src: "1 2", err: "unexpected 2 at 2"},
+		{src: "a.", err: "expected a name at 2"},
+		{src: "a.1", err: "expected a name at 2"},
+		{src: "true ? 1", err: "expected : at 8"},
+		{src: "'open", err: "unterminated string at 0"},
+		{src: "1.2.3", err: "invalid number 1.2.3 at 0"},
+		{src: "a # b", err: `unexpected '#' at 2`},
+		{src: "unknown(1)", err: "unknown function unknown"},
+		{src: "size(1, 2)", err: "size takes one argument"},
+		{src: "a.unknown()", err: "unknown method unknown"},
+		{src: "a.lower(1)", err: "lower takes no arguments"},
+		{src: "a.exists(x)", err: "exists takes a variable and a predicate"},
+		{src: "a.all('x', true)", err: "all takes a variable name as first argument"},
+		{src: "a.matches('(')", err: "error parsing regexp"},
+		{src: "a.matches(1)", err: "matches takes a string pattern"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.src)
+
+		if err == nil {
+			t.Errorf("%q: expected error %q", test.src, test.err)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: expected error %q but got %q", test.src, test.err, err)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+
+	vars := Vars{
+		"object": Normalize(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"name":   "web",
+				"labels": map[string]string{"app": "web"},
+			},
+			"spec": map[string]interface{}{
+				"replicas":   3,
+				"containers": []interface{}{map[string]interface{}{"image": "nginx:1.15"}},
+			},
+		}),
+		"groups": Normalize([]string{"admins", "devs"}),
+		"empty":  nil,
+	}
+
+	tests := []struct {
+		src      string
+		expected interface{}
+	}{
+		// precedence
+		{src: "1 + 2 * 3", expected: int64(7)},
+		{src: "(1 + 2) * 3", expected: int64(9)},
+		{src: "10 - 4 - 3", expected: int64(3)},
+		{src: "7 / 2", expected: int64(3)},
+		{src: "7.0 / 2", expected: 3.5},
+		{src: "7 % 4 * 2", expected: int64(6)},
+		{src: "-2 * 3", expected: int64(-6)},
+		{src: "1 + 2 == 3", expected: true},
+		{src: "1 < 2 == true", expected: true},
+		{src: "true || false && false", expected: true},
+		{src: "!false && false", expected: false},
+		{src: "false ? 1 : true ? 2 : 3", expected: int64(2)},
+		{src: "1 + 1 > 1 ? 'a' + 'b' : 'c'", expected: "ab"},
+		{src: "'devs' in groups && object.spec.replicas >= 3", expected: true},
+
+		// values
+		{src: "1 == 1.0", expected: true},
+		{src: "'a' < 'b'", expected: true},
+		{src: "[1, 2] + [3]", expected: []interface{}{int64(1), int64(2), int64(3)}},
+		{src: "'app' in object.metadata.labels", expected: true},
+		{src: "size(groups)", expected: int64(2)},
+		{src: "groups[1]", expected: "devs"},
+		{src: "object.spec.containers[0].image.startsWith('nginx:')", expected: true},
+		{src: "object.metadata['name'].upper()", expected: "WEB"},
+		{src: "object.metadata.name.matches('^w')", expected: true},
+		{src: "groups.exists(g, g == 'admins')", expected: true},
+		{src: "groups.all(g, g.endsWith('s'))", expected: true},
+		{src: "int('42') + 1", expected: int64(43)},
+		{src: "string(1.5)", expected: "1.5"},
+
+		// null and missing fields
+		{src: "null", expected: nil},
+		{src: "empty == null", expected: true},
+		{src: "object.status", expected: nil},
+		{src: "object.status.phase", expected: nil},
+		{src: "object.metadata.labels['missing']", expected: nil},
+		{src: "empty[0]", expected: nil},
+		{src: "has(object.metadata.annotations)", expected: false},
+		{src: "has(object.metadata.labels.app)", expected: true},
+		{src: "size(object.status)", expected: int64(0)},
+		{src: "object.status.phase.startsWith('R')", expected: false},
+		{src: "'x' in object.status", expected: false},
+		{src: "object.status.conditions.exists(c, true)", expected: false},
+		{src: "object.status.conditions.all(c, false)", expected: true},
+
+		// short circuit skips the error of the right side
+		{src: "false && undefined", expected: false},
+		{src: "true || 1 / 0 == 0", expected: true},
+	}
+
+	for _, test := range tests {
+		e, err := Parse(test.src)
+
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
+
+		value, err := e.Eval(vars)
+
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("%q: expected %#v but got %#v", test.src, test.expected, value)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+
+	vars := Vars{
+		"list":   []interface{}{int64(1), int64(2)},
+		"object": map[string]interface{}{"name": "web"},
+	}
+
+	tests := []struct {
+		src string
+		err string
+	}{
+		// out of range and negative indexes
+		{src: "list[2]", err: "list index 2 out of range [0, 2)"},
+		{src: "list[-1]", err: "list index -1 out of range [0, 2)"},
+		{src: "[][0]", err: "list index 0 out of range [0, 0)"},
+		{src: "list['a']", err: "list index is string, not an int"},
+		{src: "object[0]", err: "map index is int, not a string"},
+		{src: "'abc'[0]", err: "string can not be indexed"},
+
+		{src: "undefined", err: "undefined variable undefined"},
+		{src: "object.name.first", err: "string has no member first"},
+		{src: "1 / 0", err: "division by zero"},
+		{src: "1 % 0", err: "division by zero"},
+		{src: "1 + 'a'", err: "+ is not defined on int and string"},
+		{src: "1 < 'a'", err: "< is not defined on int and string"},
+		{src: "!1", err: "! is not defined on int"},
+		{src: "-'a'", err: "- is not defined on string"},
+		{src: "1 && true", err: "&& is not defined on int"},
+		{src: "null ? 1 : 2", err: "?: is not defined on null"},
+		{src: "1 in 'abc'", err: "in is not defined on string"},
+		{src: "int('x')", err: "invalid syntax"},
+		{src: "list.exists(x, x)", err: "exists is not defined on int"},
+	}
+
+	for _, test := range tests {
+		e, err := Parse(test.src)
+
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
+
+		_, err = e.Eval(vars)
+
+		if err == nil {
+			t.Errorf("%q: expected error %q", test.src, test.err)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: expected error %q but got %q", test.src, test.err, err)
+		}
+	}
+}
+
+func TestEvalBool(t *testing.T) {
+
+	e, err := Parse("size(name)")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.EvalBool(Vars{"name": "web"}); err == nil || err.Error() != "size(name) is int, not a bool" {
+		t.Errorf("expected a not a bool error but got %v", err)
+	}
+}
@@ -0,0 +1,458 @@
+// Package expression is a small CEL-like expression language for admission policies.
+//
+// Values are null, bools, int64 and float64 numbers, strings, lists and string keyed maps.
+// Supported are literals, [lists], member access a.b, indexes a["b"] and a[0], the operators
+// ! - * / % + - == != < <= > >= in && || and ?:, the functions size(x), has(x), int(x), string(x),
+// and the methods startsWith, endsWith, contains, matches, lower, upper, size, exists(v, p) and all(v, p).
+// A member or key missing from a map, or accessed on null, is null. A list index out of range,
+// including a negative index, is an error.
+package expression
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenInt
+	tokenFloat
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+// operators longest first
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "+", "-", "*", "/", "%", "?", ":", ".", ",", "(", ")", "[", "]"}
+
+func tokenize(src string) ([]token, error) {
+
+	tokens := make([]token, 0)
+
+	for i := 0; i < len(src); {
+
+		c := rune(src[i])
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: src[start:i], pos: start})
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			text := src[start:i]
+			if strings.Contains(text, ".") {
+				value, err := strconv.ParseFloat(text, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid number %s at %d", text, start)
+				}
+				tokens = append(tokens, token{kind: tokenFloat, text: text, value: value, pos: start})
+			} else {
+				value, err := strconv.ParseInt(text, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid number %s at %d", text, start)
+				}
+				tokens = append(tokens, token{kind: tokenInt, text: text, value: value, pos: start})
+			}
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			for i < len(src) && rune(src[i]) != c {
+				if src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			quoted := src[start:i]
+			if c == '\'' {
+				quoted = `"` + strings.Replace(strings.Replace(quoted[1:len(quoted)-1], `"`, `\"`, -1), `\'`, `'`, -1) + `"`
+			}
+			value, err := strconv.Unquote(quoted)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d: %v", start, err)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: src[start:i], value: value, pos: start})
+		default:
+			matched := false
+			for _, operator := range operators {
+				if strings.HasPrefix(src[i:], operator) {
+					tokens = append(tokens, token{kind: tokenOperator, text: operator, pos: i})
+					i += len(operator)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+// Expression is a compiled expression
+type Expression struct {
+	source string
+	root   node
+}
+
+// Parse compiles src
+func Parse(src string) (*Expression, error) {
+
+	tokens, err := tokenize(src)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+
+	root, err := p.ternary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at %d", p.peek().text, p.peek().pos)
+	}
+
+	return &Expression{source: src, root: root}, nil
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+type parser struct {
+	tokens []token
+	next   int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) take() token {
+	t := p.tokens[p.next]
+	if t.kind != tokenEOF {
+		p.next++
+	}
+	return t
+}
+
+func (p *parser) accept(operators ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokenOperator && !(t.kind == tokenIdent && t.text == "in") {
+		return "", false
+	}
+	for _, operator := range operators {
+		if t.text == operator {
+			p.next++
+			return operator, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) expect(operator string) error {
+	if _, ok := p.accept(operator); !ok {
+		return fmt.Errorf("expected %s at %d", operator, p.peek().pos)
+	}
+	return nil
+}
+
+func (p *parser) ternary() (node, error) {
+
+	condition, err := p.binary(0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := p.accept("?"); !ok {
+		return condition, nil
+	}
+
+	then, err := p.ternary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+
+	otherwise, err := p.ternary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &conditional{condition: condition, then: then, otherwise: otherwise}, nil
+}
+
+// binary operators by increasing precedence
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) binary(level int) (node, error) {
+
+	if level == len(precedence) {
+		return p.unary()
+	}
+
+	left, err := p.binary(level + 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		operator, ok := p.accept(precedence[level]...)
+
+		if !ok {
+			return left, nil
+		}
+
+		right, err := p.binary(level + 1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binary{operator: operator, left: left, right: right}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+
+	if operator, ok := p.accept("!", "-"); ok {
+		operand, err := p.unary()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &unary{operator: operator, operand: operand}, nil
+	}
+
+	return p.postfix()
+}
+
+func (p *parser) postfix() (node, error) {
+
+	target, err := p.primary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if _, ok := p.accept("."); ok {
+			name := p.take()
+
+			if name.kind != tokenIdent {
+				return nil, fmt.Errorf("expected a name at %d", name.pos)
+			}
+
+			if _, ok := p.accept("("); ok {
+				args, err := p.arguments(")")
+
+				if err != nil {
+					return nil, err
+				}
+
+				if target, err = newMethod(target, name.text, args); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			target = &member{target: target, name: name.text}
+			continue
+		}
+
+		if _, ok := p.accept("["); ok {
+			key, err := p.ternary()
+
+			if err != nil {
+				return nil, err
+			}
+
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+
+			target = &index{target: target, key: key}
+			continue
+		}
+
+		return target, nil
+	}
+}
+
+func (p *parser) primary() (node, error) {
+
+	t := p.take()
+
+	switch t.kind {
+	case tokenInt, tokenFloat, tokenString:
+		return &literal{value: t.value}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &literal{value: true}, nil
+		case "false":
+			return &literal{value: false}, nil
+		case "null":
+			return &literal{value: nil}, nil
+		}
+
+		if _, ok := p.accept("("); ok {
+			args, err := p.arguments(")")
+
+			if err != nil {
+				return nil, err
+			}
+
+			return newFunction(t.text, args)
+		}
+
+		return &variable{name: t.text}, nil
+	case tokenOperator:
+		switch t.text {
+		case "(":
+			inner, err := p.ternary()
+
+			if err != nil {
+				return nil, err
+			}
+
+			return inner, p.expect(")")
+		case "[":
+			items, err := p.arguments("]")
+
+			if err != nil {
+				return nil, err
+			}
+
+			return &list{items: items}, nil
+		}
+	}
+
+	if t.kind == tokenEOF {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	return nil, fmt.Errorf("unexpected %s at %d", t.text, t.pos)
+}
+
+func (p *parser) arguments(closing string) ([]node, error) {
+
+	args := make([]node, 0)
+
+	if _, ok := p.accept(closing); ok {
+		return args, nil
+	}
+
+	for {
+		arg, err := p.ternary()
+
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, arg)
+
+		if _, ok := p.accept(","); ok {
+			continue
+		}
+
+		return args, p.expect(closing)
+	}
+}
+
+func newFunction(name string, args []node) (node, error) {
+
+	switch name {
+	case "size", "has", "int", "string":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s takes one argument", name)
+		}
+		return &function{name: name, args: args}, nil
+	}
+
+	return nil, fmt.Errorf("unknown function %s", name)
+}
+
+func newMethod(target node, name string, args []node) (node, error) {
+
+	switch name {
+	case "startsWith", "endsWith", "contains":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s takes one argument", name)
+		}
+	case "matches":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("matches takes one argument")
+		}
+		// compile a literal pattern once
+		if pattern, ok := args[0].(*literal); ok {
+			text, ok := pattern.value.(string)
+			if !ok {
+				return nil, fmt.Errorf("matches takes a string pattern")
+			}
+			re, err := regexp.Compile(text)
+			if err != nil {
+				return nil, err
+			}
+			return &method{target: target, name: name, args: args, pattern: re}, nil
+		}
+	case "lower", "upper", "size":
+		if len(args) != 0 {
+			return nil, fmt.Errorf("%s takes no arguments", name)
+		}
+	case "exists", "all":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s takes a variable and a predicate", name)
+		}
+		if _, ok := args[0].(*variable); !ok {
+			return nil, fmt.Errorf("%s takes a variable name as first argument", name)
+		}
+	default:
+		return nil, fmt.Errorf("unknown method %s", name)
+	}
+
+	return &method{target: target, name: name, args: args}, nil
+}
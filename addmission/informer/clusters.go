@@ -0,0 +1,349 @@
+package informer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/listers/rbac/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// ClusterLabel on a kubeconfig Secret names the cluster, the Secret name is used without it
+const ClusterLabel = "kubesphere.io/cluster"
+
+// kubeconfig keys of cluster Secrets, tried in order
+var kubeconfigSecretKeys = []string{"config", "kubeconfig"}
+
+// Listers are the RBAC and Namespace caches of one cluster and its client
+type Listers struct {
+	ClusterRoleBindings v1.ClusterRoleBindingLister
+	ClusterRoles        v1.ClusterRoleLister
+	RoleBindings        v1.RoleBindingLister
+	Roles               v1.RoleLister
+	Namespaces          corev1.NamespaceLister
+	// Client reads the objects of the cluster, nil without an API server
+	Client kubernetes.Interface
+
+	stop    chan struct{}
+	ready   chan struct{}
+	version string
+	owners  int
+}
+
+// member clusters by name
+var clusters = struct {
+	sync.RWMutex
+	listers map[string]*Listers
+}{listers: make(map[string]*Listers)}
+
+// DefaultListers are the shared listers of Start or StartFromDirectory
+func DefaultListers() *Listers {
+	return &Listers{
+		ClusterRoleBindings: ClusterRoleBindingLister,
+		ClusterRoles:        ClusterRoleLister,
+		RoleBindings:        RoleBindingLister,
+		Roles:               RoleLister,
+		Namespaces:          NamespaceLister,
+		Client:              sharedClient,
+	}
+}
+
+// Cluster returns the listers of a member cluster
+func Cluster(name string) (*Listers, bool) {
+	clusters.RLock()
+	defer clusters.RUnlock()
+	listers, ok := clusters.listers[name]
+	return listers, ok
+}
+
+// ClusterNames lists the member clusters
+func ClusterNames() []string {
+	clusters.RLock()
+	defer clusters.RUnlock()
+	names := make([]string, 0, len(clusters.listers))
+	for name := range clusters.listers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AddCluster starts the informers of a member cluster and returns its listers, which are
+// ready once the caches are synced. The cluster of the same name is replaced unless version, a
+// fingerprint of its configuration, is unchanged, then its listers are shared. The caller owns
+// the listers until releaseCluster. The rate limits, user agent and resync period of
+// clientConfig apply to the member cluster.
+func AddCluster(name string, config *rest.Config, version string, clientConfig ClientConfig) (*Listers, error) {
+
+	clusters.Lock()
+	defer clusters.Unlock()
+
+	if current, ok := clusters.listers[name]; ok && current.version == version {
+		current.owners++
+		return current, nil
+	}
+
+	clientConfig.tune(config)
+
+	client, err := kubernetes.NewForConfig(config)
+
+	if err != nil {
+		return nil, fmt.Errorf("cluster %s: %v", name, err)
+	}
+
+	factory := informers.NewSharedInformerFactory(client, clientConfig.resyncPeriod())
+
+	listers := &Listers{
+		ClusterRoleBindings: factory.Rbac().V1().ClusterRoleBindings().Lister(),
+		ClusterRoles:        factory.Rbac().V1().ClusterRoles().Lister(),
+		RoleBindings:        factory.Rbac().V1().RoleBindings().Lister(),
+		Roles:               factory.Rbac().V1().Roles().Lister(),
+		Namespaces:          factory.Core().V1().Namespaces().Lister(),
+		Client:              client,
+		stop:                make(chan struct{}),
+		ready:               make(chan struct{}),
+		version:             version,
+		owners:              1,
+	}
+
+	factory.Start(listers.stop)
+
+	// an unreachable cluster stays not ready and does not hold up the others
+	go func() {
+		for _, synced := range factory.WaitForCacheSync(listers.stop) {
+			if !synced {
+				return
+			}
+		}
+		close(listers.ready)
+		log.Printf("cluster %s ready", name)
+	}()
+
+	// the replaced listers keep running for their other owners until they release them
+	clusters.listers[name] = listers
+
+	log.Printf("cluster %s added", name)
+
+	return listers, nil
+}
+
+// Ready reports whether the caches of the cluster are synced
+func (l *Listers) Ready() bool {
+
+	if l.ready == nil {
+		return true
+	}
+
+	select {
+	case <-l.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseCluster gives up an ownership of the listers of a member cluster, the last owner
+// stops their informers and removes the cluster unless it was replaced
+func releaseCluster(name string, listers *Listers) {
+
+	clusters.Lock()
+	defer clusters.Unlock()
+
+	if listers.owners--; listers.owners > 0 {
+		return
+	}
+
+	close(listers.stop)
+
+	if clusters.listers[name] == listers {
+		delete(clusters.listers, name)
+		log.Printf("cluster %s removed", name)
+	}
+}
+
+// syncClusters adds the clusters of configs and releases the other clusters previously added from the same source
+func syncClusters(source string, owned map[string]*Listers, configs map[string]*rest.Config, versions map[string]string, clientConfig ClientConfig) {
+
+	for name, config := range configs {
+
+		listers, err := AddCluster(name, config, versions[name], clientConfig)
+
+		if err != nil {
+			log.Printf("%s: %v", source, err)
+			continue
+		}
+
+		if previous, ok := owned[name]; ok {
+			releaseCluster(name, previous)
+		}
+
+		owned[name] = listers
+	}
+
+	for name, listers := range owned {
+		if _, ok := configs[name]; !ok {
+			releaseCluster(name, listers)
+			delete(owned, name)
+		}
+	}
+}
+
+// releaseClusters releases the clusters added from a source
+func releaseClusters(owned map[string]*Listers) {
+
+	for name, listers := range owned {
+		releaseCluster(name, listers)
+	}
+}
+
+// StartClustersFromKubeconfig adds a member cluster per context of the kubeconfig file, named
+// after the context. The file is polled until stop is closed, contexts added or removed add or
+// remove clusters. The clusters are added without waiting for their caches to sync.
+func StartClustersFromKubeconfig(path string, clientConfig ClientConfig, stop <-chan struct{}) error {
+
+	owned := make(map[string]*Listers)
+	fingerprint := ""
+
+	load := func() error {
+
+		data, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+
+		if hex.EncodeToString(sum[:]) == fingerprint {
+			return nil
+		}
+
+		kubeconfig, err := clientcmd.Load(data)
+
+		if err != nil {
+			return err
+		}
+
+		configs := make(map[string]*rest.Config)
+		versions := make(map[string]string)
+
+		for name := range kubeconfig.Contexts {
+			config, err := clientcmd.NewNonInteractiveClientConfig(*kubeconfig, name, &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+
+			if err != nil {
+				return fmt.Errorf("context %s: %v", name, err)
+			}
+
+			configs[name] = config
+			versions[name] = hex.EncodeToString(sum[:])
+		}
+
+		syncClusters("kubeconfig "+path, owned, configs, versions, clientConfig)
+		fingerprint = hex.EncodeToString(sum[:])
+
+		return nil
+	}
+
+	if err := load(); err != nil {
+		return fmt.Errorf("kubeconfig %s: %v", path, err)
+	}
+
+	// the clusters of the source are released with the site once stop is closed
+	go func() {
+		wait.Until(func() {
+			if err := load(); err != nil {
+				log.Printf("kubeconfig %s could not be reloaded: %v", path, err)
+			}
+		}, PolicyPollInterval, stop)
+
+		releaseClusters(owned)
+	}()
+
+	return nil
+}
+
+// StartClustersFromSecrets adds a member cluster per kubeconfig Secret in namespace matching
+// selector, read from the cluster of clientConfig. Secrets are polled until stop is closed,
+// created or deleted Secrets add or remove clusters.
+func StartClustersFromSecrets(namespace string, selector string, clientConfig ClientConfig, stop <-chan struct{}) error {
+
+	client, err := NewClientset(clientConfig)
+
+	if err != nil {
+		return err
+	}
+
+	owned := make(map[string]*Listers)
+
+	load := func() error {
+
+		secrets, err := client.CoreV1().Secrets(namespace).List(metav1.ListOptions{LabelSelector: selector})
+
+		if err != nil {
+			return err
+		}
+
+		configs := make(map[string]*rest.Config)
+		versions := make(map[string]string)
+
+		for _, secret := range secrets.Items {
+
+			name := secret.Labels[ClusterLabel]
+
+			if name == "" {
+				name = secret.Name
+			}
+
+			for _, key := range kubeconfigSecretKeys {
+				data, ok := secret.Data[key]
+
+				if !ok {
+					continue
+				}
+
+				config, err := clientcmd.RESTConfigFromKubeConfig(data)
+
+				if err != nil {
+					log.Printf("secret %s/%s: %v", secret.Namespace, secret.Name, err)
+					break
+				}
+
+				configs[name] = config
+				versions[name] = secret.ResourceVersion
+				break
+			}
+		}
+
+		syncClusters("secrets "+namespace+" "+selector, owned, configs, versions, clientConfig)
+
+		return nil
+	}
+
+	if err := load(); err != nil {
+		return fmt.Errorf("cluster secrets in %s: %v", namespace, err)
+	}
+
+	// the clusters of the source are released with the site once stop is closed
+	go func() {
+		wait.Until(func() {
+			if err := load(); err != nil {
+				log.Printf("cluster secrets in %s could not be reloaded: %v", namespace, err)
+			}
+		}, PolicyPollInterval, stop)
+
+		releaseClusters(owned)
+	}()
+
+	return nil
+}
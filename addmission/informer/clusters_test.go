@@ -0,0 +1,53 @@
+package informer
+
+import (
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+func TestClusterOwners(t *testing.T) {
+
+	// nothing listens, the caches never sync
+	config := &rest.Config{Host: "http://127.0.0.1:1"}
+
+	first, err := AddCluster("test-owners", config, "1", ClientConfig{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Ready() {
+		t.Errorf("expected an unreachable cluster not to be ready")
+	}
+
+	// another site of the same configuration
+	if shared, err := AddCluster("test-owners", config, "1", ClientConfig{}); err != nil || shared != first {
+		t.Errorf("expected the same version to share the cluster but got %v", err)
+	}
+
+	releaseCluster("test-owners", first)
+
+	if listers, ok := Cluster("test-owners"); !ok || listers != first {
+		t.Errorf("expected the cluster to be kept for its other owner")
+	}
+
+	replaced, err := AddCluster("test-owners", config, "2", ClientConfig{})
+
+	if err != nil || replaced == first {
+		t.Fatalf("expected another version to replace the cluster but got %v", err)
+	}
+
+	// the last owner of the previous version shuts down after the reload
+	releaseCluster("test-owners", first)
+
+	if listers, ok := Cluster("test-owners"); !ok || listers != replaced {
+		t.Errorf("expected the release of the previous version to keep the replaced cluster")
+	}
+
+	releaseCluster("test-owners", replaced)
+
+	if _, ok := Cluster("test-owners"); ok {
+		t.Errorf("expected the cluster to be removed with its last owner")
+	}
+}
@@ -2,57 +2,158 @@ package informer
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
-	"os/signal"
-	"syscall"
+	"strings"
 	"time"
 
 	"k8s.io/client-go/informers"
-	"k8s.io/client-go/informers/rbac/v1"
 	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/listers/rbac/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 const EnvKubeConfig = "KUBECONFIG"
 
-func loadConfig() (*rest.Config, error) {
-	configFile := os.Getenv(EnvKubeConfig)
+// ClientConfig selects and tunes the connection to the API server. Without Kubeconfig the
+// KUBECONFIG environment variable or the in-cluster config is used, unless Server is set.
+// Server, CAFile and TokenFile override the loaded config.
+type ClientConfig struct {
+	Kubeconfig string
+	Context    string
+	Server     string
+	CAFile     string
+	TokenFile  string
+	QPS        float32
+	Burst      int
+	Resync     time.Duration
+	UserAgent  string
+}
+
+const defaultResync = time.Second * 30
+
+func (clientConfig ClientConfig) resyncPeriod() time.Duration {
+	if clientConfig.Resync > 0 {
+		return clientConfig.Resync
+	}
+	return defaultResync
+}
+
+func (clientConfig ClientConfig) load() (*rest.Config, error) {
+
+	configFile := clientConfig.Kubeconfig
+
+	if configFile == "" {
+		configFile = os.Getenv(EnvKubeConfig)
+	}
+
 	var kubeConfig *rest.Config
-	if len(configFile) > 0 {
-		kubeConfig, err := clientcmd.BuildConfigFromFlags("", configFile)
+	var err error
+
+	switch {
+	case configFile != "":
+		loadingRules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: configFile}
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: clientConfig.Context}
+
+		kubeConfig, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+
 		if err != nil {
-			return nil, fmt.Errorf("kubeconfig provided in environment variable %s could not be read: %v", EnvKubeConfig, err)
-		} else {
-			return kubeConfig, nil
+			return nil, fmt.Errorf("kubeconfig %s could not be read: %v", configFile, err)
 		}
+	case clientConfig.Context != "":
+		return nil, fmt.Errorf("kubeconfig context %s requires a kubeconfig", clientConfig.Context)
+	case clientConfig.Server != "":
+		kubeConfig = &rest.Config{}
+	default:
+		kubeConfig, err = rest.InClusterConfig()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if clientConfig.Server != "" {
+		kubeConfig.Host = clientConfig.Server
+	}
+
+	if clientConfig.CAFile != "" {
+		kubeConfig.TLSClientConfig.CAFile = clientConfig.CAFile
+		kubeConfig.TLSClientConfig.CAData = nil
 	}
 
-	kubeConfig, err := rest.InClusterConfig()
+	if clientConfig.TokenFile != "" {
+		token, err := ioutil.ReadFile(clientConfig.TokenFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("token file could not be read: %v", err)
+		}
+
+		kubeConfig.BearerToken = strings.TrimSpace(string(token))
+	}
+
+	clientConfig.tune(kubeConfig)
+
+	return kubeConfig, nil
+}
+
+// tune applies the client rate limits and user agent
+func (clientConfig ClientConfig) tune(kubeConfig *rest.Config) {
+
+	if clientConfig.QPS > 0 {
+		kubeConfig.QPS = clientConfig.QPS
+	}
+
+	if clientConfig.Burst > 0 {
+		kubeConfig.Burst = clientConfig.Burst
+	}
+
+	if clientConfig.UserAgent != "" {
+		kubeConfig.UserAgent = clientConfig.UserAgent
+	}
+}
+
+// NewClientset connects to the cluster of clientConfig, by default the cluster of KUBECONFIG or
+// the cluster the gateway runs in
+func NewClientset(clientConfig ClientConfig) (kubernetes.Interface, error) {
+
+	kubeConfig, err := clientConfig.load()
 
 	if err != nil {
 		return nil, err
-	} else {
-		return kubeConfig, nil
 	}
+
+	return kubernetes.NewForConfig(kubeConfig)
 }
 
-// ClusterRoleBindingInformer Shared Informer
-var ClusterRoleBindingInformer v1.ClusterRoleBindingInformer
+// ClusterRoleBindingLister Shared Lister
+var ClusterRoleBindingLister v1.ClusterRoleBindingLister
+
+// ClusterRoleLister Shared Lister
+var ClusterRoleLister v1.ClusterRoleLister
 
-// ClusterRoleInformer Shared Informer
-var ClusterRoleInformer v1.ClusterRoleInformer
+// RoleBindingLister Shared Lister
+var RoleBindingLister v1.RoleBindingLister
 
-// RoleBindingInformer Shared Informer
-var RoleBindingInformer v1.RoleBindingInformer
+// RoleLister Shared Lister
+var RoleLister v1.RoleLister
 
-// RoleInformer Shared Informer
-var RoleInformer v1.RoleInformer
+// NamespaceLister Shared Lister
+var NamespaceLister corev1.NamespaceLister
+
+var sharedClient kubernetes.Interface
+
+// Started reports whether the shared listers are available
+func Started() bool {
+	return ClusterRoleBindingLister != nil
+}
 
-// Start thread
-func Start() error {
+// Start connects to the API server of clientConfig and starts the shared informers until stop
+// is closed, it fails when the API server is not reachable
+func Start(clientConfig ClientConfig, stop <-chan struct{}) error {
 
-	kubeConfig, err := loadConfig()
+	kubeConfig, err := clientConfig.load()
 
 	if err != nil {
 		return err
@@ -60,27 +161,31 @@ func Start() error {
 
 	k8s, err := kubernetes.NewForConfig(kubeConfig)
 
-	factory := informers.NewSharedInformerFactory(k8s, time.Second*30)
+	if err != nil {
+		return err
+	}
+
+	if _, err := k8s.Discovery().ServerVersion(); err != nil {
+		return fmt.Errorf("API server %s is not reachable: %v", kubeConfig.Host, err)
+	}
+
+	factory := informers.NewSharedInformerFactory(k8s, clientConfig.resyncPeriod())
 
-	ClusterRoleBindingInformer = factory.Rbac().V1().ClusterRoleBindings()
-	ClusterRoleInformer = factory.Rbac().V1().ClusterRoles()
-	RoleBindingInformer = factory.Rbac().V1().RoleBindings()
-	RoleInformer = factory.Rbac().V1().Roles()
+	clusterRoleBindingInformer := factory.Rbac().V1().ClusterRoleBindings()
+	clusterRoleInformer := factory.Rbac().V1().ClusterRoles()
+	roleBindingInformer := factory.Rbac().V1().RoleBindings()
+	roleInformer := factory.Rbac().V1().Roles()
+	namespaceInformer := factory.Core().V1().Namespaces()
 
-	stop := make(chan struct{})
-	ch := make(chan os.Signal, 2)
-	signal.Notify(ch, []os.Signal{os.Interrupt, syscall.SIGTERM}...)
+	ClusterRoleBindingLister = clusterRoleBindingInformer.Lister()
+	ClusterRoleLister = clusterRoleInformer.Lister()
+	RoleBindingLister = roleBindingInformer.Lister()
+	RoleLister = roleInformer.Lister()
+	NamespaceLister = namespaceInformer.Lister()
 
-	go func() {
-		<-ch
-		close(stop)
-		<-ch
-	}()
+	sharedClient = k8s
 
-	go ClusterRoleBindingInformer.Informer().Run(stop)
-	go ClusterRoleInformer.Informer().Run(stop)
-	go RoleBindingInformer.Informer().Run(stop)
-	go RoleInformer.Informer().Run(stop)
+	factory.Start(stop)
 
 	return nil
 }
@@ -0,0 +1,46 @@
+package informer
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+)
+
+// objectGetTimeout bounds the requests of Listers.Object
+const objectGetTimeout = time.Second * 10
+
+// Object reads an object of any resource, custom resources included, from the API server of the cluster
+func (l *Listers) Object(resource schema.GroupVersionResource, namespace string, name string) (map[string]interface{}, error) {
+
+	if l.Client == nil {
+		return nil, fmt.Errorf("objects of %s can only be read from an API server", resource.String())
+	}
+
+	segments := []string{"/apis", resource.Group, resource.Version}
+
+	if resource.Group == "" {
+		segments = []string{"/api", resource.Version}
+	}
+
+	if namespace != "" {
+		segments = append(segments, "namespaces", namespace)
+	}
+
+	segments = append(segments, resource.Resource, name)
+
+	data, err := l.Client.CoreV1().RESTClient().Get().AbsPath(segments...).Timeout(objectGetTimeout).DoRaw()
+
+	if err != nil {
+		return nil, err
+	}
+
+	object := make(map[string]interface{})
+
+	if err := utiljson.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+
+	return object, nil
+}
@@ -0,0 +1,243 @@
+package informer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	rbaclisters "k8s.io/client-go/listers/rbac/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// PolicyPollInterval how often the policy directory is checked for changes
+const PolicyPollInterval = time.Second * 10
+
+type policyStore struct {
+	dir                 string
+	fingerprint         string
+	clusterRoleBindings cache.Indexer
+	clusterRoles        cache.Indexer
+	roleBindings        cache.Indexer
+	roles               cache.Indexer
+	namespaces          cache.Indexer
+}
+
+// StartFromDirectory serves the shared listers from the Role, ClusterRole, RoleBinding,
+// ClusterRoleBinding and Namespace manifests found in dir instead of a Kubernetes API server.
+// The directory is polled and reloaded when its content changes until stop is closed. Objects of
+// other resources can not be read without an API server.
+func StartFromDirectory(dir string, stop <-chan struct{}) error {
+
+	store := &policyStore{
+		dir:                 dir,
+		clusterRoleBindings: cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+		clusterRoles:        cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+		roleBindings:        cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+		roles:               cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+		namespaces:          cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+	}
+
+	if err := store.reload(); err != nil {
+		return err
+	}
+
+	ClusterRoleBindingLister = rbaclisters.NewClusterRoleBindingLister(store.clusterRoleBindings)
+	ClusterRoleLister = rbaclisters.NewClusterRoleLister(store.clusterRoles)
+	RoleBindingLister = rbaclisters.NewRoleBindingLister(store.roleBindings)
+	RoleLister = rbaclisters.NewRoleLister(store.roles)
+	NamespaceLister = corelisters.NewNamespaceLister(store.namespaces)
+	sharedClient = nil
+
+	go wait.Until(func() {
+		if err := store.reload(); err != nil {
+			log.Printf("policy directory %s could not be reloaded: %v", dir, err)
+		}
+	}, PolicyPollInterval, stop)
+
+	return nil
+}
+
+// reload replaces the cached objects when the directory fingerprint changed,
+// a manifest that fails to decode leaves the previous snapshot in place
+func (s *policyStore) reload() error {
+
+	files, fingerprint, err := policyFiles(s.dir)
+
+	if err != nil {
+		return err
+	}
+
+	if fingerprint == s.fingerprint {
+		return nil
+	}
+
+	objects := make([]runtime.Object, 0)
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+
+		if err != nil {
+			return err
+		}
+
+		decoded, err := decodeManifests(data)
+
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+
+		objects = append(objects, decoded...)
+	}
+
+	clusterRoleBindings := make([]interface{}, 0)
+	clusterRoles := make([]interface{}, 0)
+	roleBindings := make([]interface{}, 0)
+	roles := make([]interface{}, 0)
+	namespaces := make([]interface{}, 0)
+
+	for _, obj := range objects {
+		switch obj.(type) {
+		case *rbacv1.ClusterRoleBinding:
+			clusterRoleBindings = append(clusterRoleBindings, obj)
+		case *rbacv1.ClusterRole:
+			clusterRoles = append(clusterRoles, obj)
+		case *rbacv1.RoleBinding:
+			roleBindings = append(roleBindings, obj)
+		case *rbacv1.Role:
+			roles = append(roles, obj)
+		case *v1.Namespace:
+			namespaces = append(namespaces, obj)
+		}
+	}
+
+	if err := s.clusterRoleBindings.Replace(clusterRoleBindings, fingerprint); err != nil {
+		return err
+	}
+	if err := s.clusterRoles.Replace(clusterRoles, fingerprint); err != nil {
+		return err
+	}
+	if err := s.roleBindings.Replace(roleBindings, fingerprint); err != nil {
+		return err
+	}
+	if err := s.roles.Replace(roles, fingerprint); err != nil {
+		return err
+	}
+	if err := s.namespaces.Replace(namespaces, fingerprint); err != nil {
+		return err
+	}
+
+	s.fingerprint = fingerprint
+
+	log.Printf("policy directory %s loaded: %d clusterrolebindings, %d clusterroles, %d rolebindings, %d roles, %d namespaces",
+		s.dir, len(clusterRoleBindings), len(clusterRoles), len(roleBindings), len(roles), len(namespaces))
+
+	return nil
+}
+
+// policyFiles lists the manifests under dir with a fingerprint of their names, sizes and modification times
+func policyFiles(dir string) ([]string, string, error) {
+
+	files := make([]string, 0)
+	fingerprint := &bytes.Buffer{}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			// skip hidden directories such as the ..data links of mounted ConfigMaps
+			if path != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+			files = append(files, path)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	sort.Strings(files)
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, "", err
+		}
+		fmt.Fprintf(fingerprint, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return files, fingerprint.String(), nil
+}
+
+// decodeManifests decodes every document of a multi-document YAML or JSON file, List kinds are flattened
+func decodeManifests(data []byte) ([]runtime.Object, error) {
+
+	objects := make([]runtime.Object, 0)
+	reader := yaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+
+	for {
+		doc, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(doc, nil, nil)
+
+		// kinds unknown to the scheme can not hold RBAC policy
+		if runtime.IsNotRegisteredError(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if list, ok := obj.(*v1.List); ok {
+			for _, item := range list.Items {
+				items, err := decodeManifests(item.Raw)
+				if err != nil {
+					return nil, err
+				}
+				objects = append(objects, items...)
+			}
+			continue
+		}
+
+		objects = append(objects, obj)
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,187 @@
+package admission
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+// filtersList reports whether a denied list of attrs may be passed to the upstream
+// and filtered to the items the user can get
+func (r Rule) filtersList(attrs authorizer.Attributes) bool {
+	return attrs.IsResourceRequest() && attrs.GetVerb() == "list" && attrs.GetSubresource() == "" &&
+		(hasString(r.ListFilter, "*") || hasString(r.ListFilter, attrs.GetResource()))
+}
+
+// serveFilteredList forwards a list the user may not run as a whole and answers with the
+// items the user is allowed to get. The upstream is asked for plain JSON, a page keeps its
+// continue token but loses remainingItemCount as the count no longer holds.
+func (c Admission) serveFilteredList(w http.ResponseWriter, r *http.Request, attrs authorizer.Attributes) (int, error) {
+
+	r.Header.Set("Accept", "application/json")
+	r.Header.Del("Accept-Encoding")
+
+	recorder := newBufferedResponseWriter()
+
+	code, err := c.Next.ServeHTTP(recorder, r)
+
+	if err != nil {
+		return code, err
+	}
+
+	if recorder.code == 0 {
+		// the next handler left writing the response to the server
+		return code, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(recorder.Header().Get("Content-Type"))
+
+	if recorder.code != http.StatusOK || mediaType != "application/json" {
+		if recorder.code == http.StatusOK {
+			err = errors.NewForbidden(schema.GroupResource{Group: attrs.GetAPIGroup(), Resource: attrs.GetResource()}, "", fmt.Errorf("cannot filter %s response", mediaType))
+			return handleForbidden(w, err), nil
+		}
+		return recorder.flush(w, recorder.body.Bytes())
+	}
+
+	body, err := filterListItems(recorder.body.Bytes(), attrs)
+
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+
+	return recorder.flush(w, body)
+}
+
+type listMetadata struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+// filterListItems removes the items of a list the user of attrs can not get, unknown fields are kept as they are
+func filterListItems(data []byte, attrs authorizer.Attributes) ([]byte, error) {
+
+	list := make(map[string]json.RawMessage)
+
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	items := make([]json.RawMessage, 0)
+
+	if raw, ok := list["items"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, err
+		}
+	}
+
+	allowed := make([]json.RawMessage, 0, len(items))
+
+	for _, item := range items {
+
+		object := struct {
+			Metadata listMetadata `json:"metadata"`
+		}{}
+
+		if err := json.Unmarshal(item, &object); err != nil {
+			return nil, err
+		}
+
+		namespace := object.Metadata.Namespace
+
+		if namespace == "" {
+			namespace = attrs.GetNamespace()
+		}
+
+		permitted, err := admissionValidate(withCluster(attrs, authorizer.AttributesRecord{
+			User:            attrs.GetUser(),
+			Verb:            "get",
+			Namespace:       namespace,
+			APIGroup:        attrs.GetAPIGroup(),
+			APIVersion:      attrs.GetAPIVersion(),
+			Resource:        attrs.GetResource(),
+			Name:            object.Metadata.Name,
+			ResourceRequest: true,
+		}))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if permitted {
+			allowed = append(allowed, item)
+		}
+	}
+
+	raw, err := json.Marshal(allowed)
+
+	if err != nil {
+		return nil, err
+	}
+
+	list["items"] = raw
+
+	if metadata, ok := list["metadata"]; ok {
+		fields := make(map[string]json.RawMessage)
+
+		if err := json.Unmarshal(metadata, &fields); err != nil {
+			return nil, err
+		}
+
+		delete(fields, "remainingItemCount")
+
+		if list["metadata"], err = json.Marshal(fields); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(list)
+}
+
+// bufferedResponseWriter holds a response until it has been filtered
+type bufferedResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{header: make(http.Header)}
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponseWriter) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *bufferedResponseWriter) Write(data []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(data)
+}
+
+func (b *bufferedResponseWriter) flush(w http.ResponseWriter, body []byte) (int, error) {
+
+	for name, values := range b.header {
+		w.Header()[name] = values
+	}
+
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(b.code)
+	w.Write(body)
+
+	// written, like the proxy does
+	return 0, nil
+}
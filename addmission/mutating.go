@@ -0,0 +1,397 @@
+package admission
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+const (
+	MutateLabel      = "labels"
+	MutateAnnotation = "annotations"
+)
+
+// admissionPatchHeader carries the base64 encoded JSON patch applied to a request body to the upstream
+const admissionPatchHeader = "X-Admission-Patch"
+
+// MutatingHook sets a label or annotation Key to the value of Template on objects created
+// or updated on Resources, or * for every resource. A created object gets the value, an updated
+// object keeps the value of the stored object, or gets the value when the stored object lacks
+// the key, so the creator of an object is kept. Values sent by the client are replaced, unless the
+// stored object of an update can not be read, and patches changing the key are rejected.
+type MutatingHook struct {
+	Field     string
+	Key       string
+	Template  *template.Template
+	Resources []string
+}
+
+// mutationData is the input of mutating templates, e.g. {{.Username}} or {{.Workspace}}
+type mutationData struct {
+	Username  string
+	UID       string
+	Groups    []string
+	Namespace string
+	Workspace string
+	Resource  string
+}
+
+// jsonPatchOperation is a RFC 6902 operation
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+func NewMutatingHook(field string, key string, text string, resources []string) (*MutatingHook, error) {
+
+	if field != MutateLabel && field != MutateAnnotation {
+		return nil, fmt.Errorf("unknown mutating field %s", field)
+	}
+
+	tmpl, err := template.New(key).Option("missingkey=zero").Parse(text)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resources) == 0 {
+		resources = []string{"*"}
+	}
+
+	return &MutatingHook{Field: field, Key: key, Template: tmpl, Resources: resources}, nil
+}
+
+func (h *MutatingHook) matches(attrs authorizer.Attributes) bool {
+	return hasString(h.Resources, "*") || hasString(h.Resources, attrs.GetResource())
+}
+
+// mutate applies the matching hooks to the body of a create or update request of an object,
+// the body is replaced by the patched object, and rejects patches of their keys. A failure or
+// a rejection answers with a Status and returns written true.
+func mutate(w http.ResponseWriter, r *http.Request, attrs authorizer.Attributes, hooks []*MutatingHook) (bool, error) {
+
+	switch attrs.GetVerb() {
+	case "create", "update", "patch":
+	default:
+		return false, nil
+	}
+
+	if attrs.GetSubresource() != "" {
+		return false, nil
+	}
+
+	matching := make([]*MutatingHook, 0)
+
+	for _, hook := range hooks {
+		if hook.matches(attrs) {
+			matching = append(matching, hook)
+		}
+	}
+
+	if len(matching) == 0 {
+		return false, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAdmissionBody+1))
+
+	if err != nil {
+		return true, writeStatus(w, &errors.NewBadRequest(err.Error()).ErrStatus)
+	}
+
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if len(body) > maxAdmissionBody {
+		return true, writeStatus(w, &metav1.Status{Status: metav1.StatusFailure, Code: http.StatusRequestEntityTooLarge, Message: "request body exceeds 3MB"})
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if attrs.GetVerb() == "patch" {
+		return checkPatch(w, attrs, matching, mediaType, body)
+	}
+
+	switch mediaType {
+	case "application/json":
+	case "application/yaml":
+		if body, err = yaml.ToJSON(body); err != nil {
+			return true, writeStatus(w, &errors.NewBadRequest(err.Error()).ErrStatus)
+		}
+	default:
+		// protobuf clients are not the console, leave their objects alone
+		return false, nil
+	}
+
+	object := make(map[string]interface{})
+
+	if err := utiljson.Unmarshal(body, &object); err != nil {
+		return true, writeStatus(w, &errors.NewBadRequest(err.Error()).ErrStatus)
+	}
+
+	var stored metav1.Object
+	var storedErr error
+
+	if attrs.GetVerb() == "update" {
+		stored, storedErr = storedObject(attrs)
+
+		switch {
+		case errors.IsNotFound(storedErr):
+			// the update creates the object
+			stored, storedErr = nil, nil
+		case storedErr != nil:
+			log.Printf("stored %s %s/%s could not be read, the values sent are kept: %v", attrs.GetResource(), attrs.GetNamespace(), attrs.GetName(), storedErr)
+		}
+	}
+
+	data := mutationData{Namespace: attrs.GetNamespace(), Workspace: requestWorkspace(attrs), Resource: attrs.GetResource()}
+
+	if usr := attrs.GetUser(); usr != nil {
+		data.Username, data.UID, data.Groups = usr.GetName(), usr.GetUID(), usr.GetGroups()
+	}
+
+	patch := make([]jsonPatchOperation, 0)
+
+	for _, hook := range matching {
+
+		value := &bytes.Buffer{}
+
+		if err := hook.Template.Execute(value, data); err != nil {
+			return true, writeStatus(w, &errors.NewInternalError(err).ErrStatus)
+		}
+
+		desired := value.String()
+
+		switch {
+		case storedErr != nil:
+			// the value to keep is unknown, the value sent by the client is the best guess
+			continue
+		case stored != nil:
+			if current, ok := storedMetadata(stored, hook.Field)[hook.Key]; ok {
+				desired = current
+			}
+		}
+
+		// nothing to set, e.g. no workspace
+		if desired == "" {
+			continue
+		}
+
+		operations := metadataPatch(object, hook.Field, hook.Key, desired)
+		applyPatch(object, operations)
+		patch = append(patch, operations...)
+	}
+
+	if len(patch) == 0 {
+		return false, nil
+	}
+
+	if body, err = json.Marshal(object); err != nil {
+		return true, writeStatus(w, &errors.NewInternalError(err).ErrStatus)
+	}
+
+	encodedPatch, err := json.Marshal(patch)
+
+	if err != nil {
+		return true, writeStatus(w, &errors.NewInternalError(err).ErrStatus)
+	}
+
+	r.Header.Set(admissionPatchHeader, base64.StdEncoding.EncodeToString(encodedPatch))
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.Header.Set("Content-Type", "application/json")
+
+	return false, nil
+}
+
+// storedObject reads the object an update request replaces from the cluster it is requested in
+func storedObject(attrs authorizer.Attributes) (metav1.Object, error) {
+
+	resource := schema.GroupVersionResource{Group: attrs.GetAPIGroup(), Version: attrs.GetAPIVersion(), Resource: attrs.GetResource()}
+
+	object, err := listersFor(attrs).Object(resource, attrs.GetNamespace(), attrs.GetName())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &unstructured.Unstructured{Object: object}, nil
+}
+
+// checkPatch rejects a JSON, merge or strategic merge patch that changes the key of a hook,
+// the value is set by the gateway on create and kept on update
+func checkPatch(w http.ResponseWriter, attrs authorizer.Attributes, hooks []*MutatingHook, mediaType string, body []byte) (bool, error) {
+
+	var touches func(hook *MutatingHook) bool
+
+	switch mediaType {
+	case "application/json-patch+json":
+		operations := make([]jsonPatchOperation, 0)
+
+		if err := utiljson.Unmarshal(body, &operations); err != nil {
+			return true, writeStatus(w, &errors.NewBadRequest(err.Error()).ErrStatus)
+		}
+
+		touches = func(hook *MutatingHook) bool {
+			for _, operation := range operations {
+				if operation.Op == "test" {
+					continue
+				}
+				if pointerTouches(operation.Path, hook) || operation.Op == "move" && pointerTouches(operation.From, hook) {
+					return true
+				}
+			}
+			return false
+		}
+	case "application/merge-patch+json", "application/strategic-merge-patch+json":
+		patch := make(map[string]interface{})
+
+		if err := utiljson.Unmarshal(body, &patch); err != nil {
+			return true, writeStatus(w, &errors.NewBadRequest(err.Error()).ErrStatus)
+		}
+
+		touches = func(hook *MutatingHook) bool {
+			return mergePatchTouches(patch, hook)
+		}
+	default:
+		return false, nil
+	}
+
+	for _, hook := range hooks {
+		if touches(hook) {
+			err := fmt.Errorf("metadata.%s %s is set by the gateway and can not be patched", hook.Field, hook.Key)
+			return true, writeStatus(w, &errors.NewForbidden(schema.GroupResource{Group: attrs.GetAPIGroup(), Resource: attrs.GetResource()}, attrs.GetName(), err).ErrStatus)
+		}
+	}
+
+	return false, nil
+}
+
+// pointerTouches reports whether a JSON patch on pointer changes the key of hook or one of its parents
+func pointerTouches(pointer string, hook *MutatingHook) bool {
+	key := "/metadata/" + hook.Field + "/" + escapePointer(hook.Key)
+	return pointer == key || strings.HasPrefix(key, pointer+"/")
+}
+
+// mergePatchTouches reports whether a merge patch sets or removes the key of hook, or replaces
+// one of its parents with null or a strategic merge directive
+func mergePatchTouches(patch map[string]interface{}, hook *MutatingHook) bool {
+
+	metadata, ok := patch["metadata"]
+
+	if !ok {
+		return false
+	}
+
+	metadataMap, ok := metadata.(map[string]interface{})
+
+	if !ok {
+		return metadata == nil
+	}
+
+	if _, ok := metadataMap["$patch"]; ok {
+		return true
+	}
+
+	values, ok := metadataMap[hook.Field]
+
+	if !ok {
+		return false
+	}
+
+	valuesMap, ok := values.(map[string]interface{})
+
+	if !ok {
+		return values == nil
+	}
+
+	if _, ok := valuesMap["$patch"]; ok {
+		return true
+	}
+
+	_, ok = valuesMap[hook.Key]
+
+	return ok
+}
+
+func storedMetadata(object metav1.Object, field string) map[string]string {
+	if field == MutateLabel {
+		return object.GetLabels()
+	}
+	return object.GetAnnotations()
+}
+
+// metadataPatch sets metadata.<field>[key] to value, creating the maps on the way,
+// the operations are to be applied before the next call
+func metadataPatch(object map[string]interface{}, field string, key string, value string) []jsonPatchOperation {
+
+	patch := make([]jsonPatchOperation, 0)
+
+	metadata, ok := object["metadata"].(map[string]interface{})
+
+	if !ok {
+		metadata = make(map[string]interface{})
+		patch = append(patch, jsonPatchOperation{Op: "add", Path: "/metadata", Value: metadata})
+	}
+
+	values, ok := metadata[field].(map[string]interface{})
+
+	if !ok {
+		values = make(map[string]interface{})
+		patch = append(patch, jsonPatchOperation{Op: "add", Path: "/metadata/" + field, Value: values})
+	}
+
+	current, exists := values[key]
+
+	switch {
+	case !exists:
+		patch = append(patch, jsonPatchOperation{Op: "add", Path: "/metadata/" + field + "/" + escapePointer(key), Value: value})
+	case current != value:
+		patch = append(patch, jsonPatchOperation{Op: "replace", Path: "/metadata/" + field + "/" + escapePointer(key), Value: value})
+	}
+
+	return patch
+}
+
+// applyPatch applies the add and replace operations of metadataPatch
+func applyPatch(object map[string]interface{}, patch []jsonPatchOperation) {
+
+	for _, operation := range patch {
+
+		segments := strings.Split(strings.TrimPrefix(operation.Path, "/"), "/")
+		parent := object
+
+		for _, segment := range segments[:len(segments)-1] {
+			parent = parent[unescapePointer(segment)].(map[string]interface{})
+		}
+
+		parent[unescapePointer(segments[len(segments)-1])] = operation.Value
+	}
+}
+
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+func unescapePointer(segment string) string {
+	return strings.Replace(strings.Replace(segment, "~1", "/", -1), "~0", "~", -1)
+}
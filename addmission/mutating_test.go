@@ -0,0 +1,161 @@
+package admission
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"kubesphere.io/caddy-plugin/addmission/informer"
+)
+
+// objectServer answers GET requests of objects by path, other paths are not found
+func objectServer(objects map[string]string) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		w.Header().Set("Content-Type", "application/json")
+
+		object, ok := objects[r.URL.Path]
+
+		switch {
+		case !ok:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "NotFound", "code": 404}`))
+		case object == "":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(object))
+		}
+	}))
+}
+
+func TestMutate(t *testing.T) {
+
+	server := objectServer(map[string]string{
+		"/api/v1/namespaces/demo/configmaps/labelled":   `{"metadata": {"name": "labelled", "labels": {"kubesphere.io/creator": "alice"}}}`,
+		"/api/v1/namespaces/demo/configmaps/unlabelled": `{"metadata": {"name": "unlabelled"}}`,
+		"/api/v1/namespaces/demo/configmaps/broken":     "",
+	})
+
+	defer server.Close()
+
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook, err := NewMutatingHook(MutateLabel, "kubesphere.io/creator", "{{.Username}}", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		verb        string
+		object      string
+		contentType string
+		body        string
+		creator     string
+		status      int
+	}{
+		{name: "create", verb: "create", body: `{"metadata": {"name": "new"}}`, creator: "bob"},
+		{name: "create replaces the value sent", verb: "create", body: `{"metadata": {"labels": {"kubesphere.io/creator": "mallory"}}}`, creator: "bob"},
+		{name: "update keeps the stored value", verb: "update", object: "labelled", body: `{"metadata": {"labels": {"kubesphere.io/creator": "mallory"}}}`, creator: "alice"},
+		{name: "update sets a missing value", verb: "update", object: "unlabelled", body: `{"metadata": {}}`, creator: "bob"},
+		{name: "update creating the object", verb: "update", object: "missing", body: `{"metadata": {}}`, creator: "bob"},
+		{name: "unreadable stored object keeps the value sent", verb: "update", object: "broken", body: `{"metadata": {"labels": {"kubesphere.io/creator": "alice"}}}`, creator: "alice"},
+
+		{name: "merge patch of the key", verb: "patch", object: "labelled", contentType: "application/merge-patch+json", body: `{"metadata": {"labels": {"kubesphere.io/creator": "mallory"}}}`, status: http.StatusForbidden},
+		{name: "merge patch removing the labels", verb: "patch", object: "labelled", contentType: "application/merge-patch+json", body: `{"metadata": {"labels": null}}`, status: http.StatusForbidden},
+		{name: "merge patch of another label", verb: "patch", object: "labelled", contentType: "application/merge-patch+json", body: `{"metadata": {"labels": {"app": "web"}}}`},
+		{name: "strategic patch replacing the labels", verb: "patch", object: "labelled", contentType: "application/strategic-merge-patch+json", body: `{"metadata": {"labels": {"$patch": "replace", "app": "web"}}}`, status: http.StatusForbidden},
+		{name: "json patch of the key", verb: "patch", object: "labelled", contentType: "application/json-patch+json", body: `[{"op": "replace", "path": "/metadata/labels/kubesphere.io~1creator", "value": "mallory"}]`, status: http.StatusForbidden},
+		{name: "json patch replacing the labels", verb: "patch", object: "labelled", contentType: "application/json-patch+json", body: `[{"op": "add", "path": "/metadata/labels", "value": {}}]`, status: http.StatusForbidden},
+		{name: "json patch moving the key", verb: "patch", object: "labelled", contentType: "application/json-patch+json", body: `[{"op": "move", "from": "/metadata/labels/kubesphere.io~1creator", "path": "/metadata/labels/owner"}]`, status: http.StatusForbidden},
+		{name: "json patch testing the key", verb: "patch", object: "labelled", contentType: "application/json-patch+json", body: `[{"op": "test", "path": "/metadata/labels/kubesphere.io~1creator", "value": "alice"}]`},
+		{name: "json patch of another label", verb: "patch", object: "labelled", contentType: "application/json-patch+json", body: `[{"op": "add", "path": "/metadata/labels/app", "value": "web"}]`},
+	}
+
+	for _, test := range tests {
+
+		contentType := test.contentType
+
+		if contentType == "" {
+			contentType = "application/json"
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/namespaces/demo/configmaps", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", contentType)
+
+		attrs := requestAttributes{
+			Attributes: authorizer.AttributesRecord{
+				User:            &user.DefaultInfo{Name: "bob"},
+				Verb:            test.verb,
+				Namespace:       "demo",
+				APIVersion:      "v1",
+				Resource:        "configmaps",
+				Name:            test.object,
+				ResourceRequest: true,
+			},
+			listers: &informer.Listers{Client: client},
+		}
+
+		recorder := httptest.NewRecorder()
+
+		written, err := mutate(recorder, req, attrs, []*MutatingHook{hook})
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if test.status != 0 {
+			if !written || recorder.Code != test.status {
+				t.Errorf("%s: expected %d but got written %v %d", test.name, test.status, written, recorder.Code)
+			}
+			continue
+		}
+
+		if written {
+			t.Errorf("%s: unexpected %d %s", test.name, recorder.Code, recorder.Body.String())
+			continue
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.verb == "patch" {
+			if string(body) != test.body {
+				t.Errorf("%s: expected the patch to pass unchanged but got %s", test.name, body)
+			}
+			continue
+		}
+
+		object := struct {
+			Metadata struct {
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+		}{}
+
+		if err := json.Unmarshal(body, &object); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if creator := object.Metadata.Labels["kubesphere.io/creator"]; creator != test.creator {
+			t.Errorf("%s: expected creator %q but got %q", test.name, test.creator, creator)
+		}
+	}
+}
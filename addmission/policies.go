@@ -0,0 +1,401 @@
+package admission
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/kubernetes"
+	"kubesphere.io/caddy-plugin/addmission/expression"
+	"kubesphere.io/caddy-plugin/addmission/informer"
+)
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// ExpressionPolicy allows or denies the requests matching Verbs and Resources, empty for all,
+// for which Expression is true. Deny policies are evaluated before and allow policies after RBAC.
+// The variables are request, user, object (the object named by the request, read from its cluster
+// when the resource is one of the objects of a policy document, or null), namespace (the cached
+// namespace of the request or null) and now.
+type ExpressionPolicy struct {
+	Name       string   `json:"name"`
+	Effect     string   `json:"effect"`
+	Verbs      []string `json:"verbs,omitempty"`
+	Resources  []string `json:"resources,omitempty"`
+	Expression string   `json:"expression"`
+	Message    string   `json:"message,omitempty"`
+	compiled   *expression.Expression
+}
+
+// policyDocument is the YAML or JSON of a policy file or ConfigMap key, Objects are the
+// group/version/resource, or version/resource for the core group, read for the object variable
+type policyDocument struct {
+	Objects  []string            `json:"objects,omitempty"`
+	Policies []*ExpressionPolicy `json:"policies"`
+}
+
+// PolicySource is a policy file or ConfigMap, polled and recompiled when it changes. The policies
+// of a site are evaluated ordered by source name.
+type PolicySource struct {
+	Name    string
+	fetch   func() (string, map[string][]byte, error)
+	version string
+
+	lock     sync.RWMutex
+	policies []*ExpressionPolicy
+	objects  []schema.GroupResource
+}
+
+func NewPolicyFile(path string) *PolicySource {
+	return &PolicySource{Name: "file " + path, fetch: func() (string, map[string][]byte, error) {
+
+		data, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		sum := sha256.Sum256(data)
+
+		return hex.EncodeToString(sum[:]), map[string][]byte{path: data}, nil
+	}}
+}
+
+// NewPolicyConfigMap reads every key of the ConfigMap namespace/name of the cluster of clientConfig
+// as a policy document
+func NewPolicyConfigMap(namespacedName string, clientConfig informer.ClientConfig) (*PolicySource, error) {
+
+	parts := strings.Split(namespacedName, "/")
+
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("policy configmap %s is not namespace/name", namespacedName)
+	}
+
+	var client kubernetes.Interface
+
+	return &PolicySource{Name: "configmap " + namespacedName, fetch: func() (string, map[string][]byte, error) {
+
+		if client == nil {
+			clientset, err := informer.NewClientset(clientConfig)
+
+			if err != nil {
+				return "", nil, err
+			}
+
+			client = clientset
+		}
+
+		configMap, err := client.CoreV1().ConfigMaps(parts[0]).Get(parts[1], metav1.GetOptions{})
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		documents := make(map[string][]byte, len(configMap.Data))
+
+		for key, value := range configMap.Data {
+			documents[key] = []byte(value)
+		}
+
+		return configMap.ResourceVersion, documents, nil
+	}}, nil
+}
+
+// Start loads the policies, which have to compile, and reloads them on change until stop is
+// closed, then the policies are no longer enforced. A change that does not compile is logged
+// and the previous policies are kept.
+func (s *PolicySource) Start(stop <-chan struct{}) error {
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	go func() {
+		wait.Until(func() {
+			if err := s.load(); err != nil {
+				log.Printf("policies of %s could not be reloaded: %v", s.Name, err)
+			}
+		}, informer.PolicyPollInterval, stop)
+
+		s.lock.Lock()
+		s.policies, s.objects = nil, nil
+		s.lock.Unlock()
+	}()
+
+	return nil
+}
+
+func (s *PolicySource) load() error {
+
+	version, documents, err := s.fetch()
+
+	if err != nil {
+		return err
+	}
+
+	if version == s.version {
+		return nil
+	}
+
+	policies := make([]*ExpressionPolicy, 0)
+	objects := make([]schema.GroupResource, 0)
+
+	keys := make([]string, 0, len(documents))
+
+	for key := range documents {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		document := policyDocument{}
+
+		if err := yaml.Unmarshal(documents[key], &document); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+
+		for _, object := range document.Objects {
+			resource, err := parseGroupVersionResource(object)
+
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+
+			objects = append(objects, resource.GroupResource())
+		}
+
+		for _, policy := range document.Policies {
+			if err := policy.compile(); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+
+			policies = append(policies, policy)
+		}
+	}
+
+	s.lock.Lock()
+	s.policies, s.objects = policies, objects
+	s.lock.Unlock()
+
+	s.version = version
+
+	log.Printf("policies of %s loaded: %d policies, %d object resources", s.Name, len(policies), len(objects))
+
+	return nil
+}
+
+// current returns the loaded policies and the resources whose objects they read
+func (s *PolicySource) current() ([]*ExpressionPolicy, []schema.GroupResource) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.policies, s.objects
+}
+
+func (p *ExpressionPolicy) compile() error {
+
+	if p.Name == "" {
+		return fmt.Errorf("policy without name")
+	}
+
+	if p.Effect != PolicyAllow && p.Effect != PolicyDeny {
+		return fmt.Errorf("policy %s: effect must be %s or %s", p.Name, PolicyAllow, PolicyDeny)
+	}
+
+	compiled, err := expression.Parse(p.Expression)
+
+	if err != nil {
+		return fmt.Errorf("policy %s: %v", p.Name, err)
+	}
+
+	p.compiled = compiled
+
+	return nil
+}
+
+func parseGroupVersionResource(value string) (schema.GroupVersionResource, error) {
+
+	parts := strings.Split(value, "/")
+
+	switch len(parts) {
+	case 2:
+		return schema.GroupVersionResource{Version: parts[0], Resource: parts[1]}, nil
+	case 3:
+		return schema.GroupVersionResource{Group: parts[0], Version: parts[1], Resource: parts[2]}, nil
+	}
+
+	return schema.GroupVersionResource{}, fmt.Errorf("%s is not group/version/resource", value)
+}
+
+func (p *ExpressionPolicy) matches(attrs authorizer.Attributes) bool {
+
+	if len(p.Verbs) > 0 && !hasString(p.Verbs, attrs.GetVerb()) && !hasString(p.Verbs, "*") {
+		return false
+	}
+
+	if len(p.Resources) == 0 {
+		return true
+	}
+
+	if !attrs.IsResourceRequest() {
+		return false
+	}
+
+	combinedResource := attrs.GetResource()
+
+	if attrs.GetSubresource() != "" {
+		combinedResource = combinedResource + "/" + attrs.GetSubresource()
+	}
+
+	return hasString(p.Resources, "*") || hasString(p.Resources, combinedResource)
+}
+
+// policyDecision returns the first policy with effect of the site of attrs whose expression is true
+// for attrs. An expression failing to evaluate denies in deny policies and does not allow in allow policies.
+func policyDecision(attrs authorizer.Attributes, effect string) *ExpressionPolicy {
+
+	sources := append([]*PolicySource(nil), policySourcesFor(attrs)...)
+
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Name < sources[j].Name })
+
+	var vars expression.Vars
+
+	for _, source := range sources {
+
+		policies, _ := source.current()
+
+		for _, policy := range policies {
+
+			if policy.Effect != effect || !policy.matches(attrs) {
+				continue
+			}
+
+			if vars == nil {
+				vars = policyVars(attrs, sources)
+			}
+
+			result, err := policy.compiled.EvalBool(vars)
+
+			if err != nil {
+				log.Printf("policy %s: %v", policy.Name, err)
+				result = effect == PolicyDeny
+			}
+
+			if result {
+				return policy
+			}
+		}
+	}
+
+	return nil
+}
+
+func policyVars(attrs authorizer.Attributes, sources []*PolicySource) expression.Vars {
+
+	now := time.Now()
+
+	vars := expression.Vars{
+		"request": map[string]interface{}{
+			"verb":            attrs.GetVerb(),
+			"apiGroup":        attrs.GetAPIGroup(),
+			"apiVersion":      attrs.GetAPIVersion(),
+			"resource":        attrs.GetResource(),
+			"subresource":     attrs.GetSubresource(),
+			"namespace":       attrs.GetNamespace(),
+			"name":            attrs.GetName(),
+			"path":            attrs.GetPath(),
+			"resourceRequest": attrs.IsResourceRequest(),
+		},
+		"user":      nil,
+		"object":    nil,
+		"namespace": nil,
+		"now": map[string]interface{}{
+			"year":    int64(now.Year()),
+			"month":   int64(now.Month()),
+			"day":     int64(now.Day()),
+			"weekday": int64(now.Weekday()),
+			"hour":    int64(now.Hour()),
+			"minute":  int64(now.Minute()),
+			"unix":    now.Unix(),
+		},
+	}
+
+	if usr := attrs.GetUser(); usr != nil {
+		vars["user"] = map[string]interface{}{
+			"name":   usr.GetName(),
+			"uid":    usr.GetUID(),
+			"groups": expression.Normalize(usr.GetGroups()),
+			"extra":  expression.Normalize(usr.GetExtra()),
+		}
+	}
+
+	if attrs.IsResourceRequest() && attrs.GetName() != "" && readsObject(sources, schema.GroupResource{Group: attrs.GetAPIGroup(), Resource: attrs.GetResource()}) {
+		vars["object"] = requestObject(attrs)
+	}
+
+	if listers := listersFor(attrs); attrs.GetNamespace() != "" && listers.Namespaces != nil {
+		if ns, err := listers.Namespaces.Get(attrs.GetNamespace()); err == nil {
+			vars["namespace"] = toUnstructured(ns)
+		}
+	}
+
+	return vars
+}
+
+// readsObject reports whether a source reads the objects of resource for the object variable
+func readsObject(sources []*PolicySource, resource schema.GroupResource) bool {
+
+	for _, source := range sources {
+
+		_, objects := source.current()
+
+		for _, object := range objects {
+			if object == resource {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// requestObject reads the object named by attrs from the cluster it is requested in
+func requestObject(attrs authorizer.Attributes) interface{} {
+
+	resource := schema.GroupVersionResource{Group: attrs.GetAPIGroup(), Version: attrs.GetAPIVersion(), Resource: attrs.GetResource()}
+
+	object, err := listersFor(attrs).Object(resource, attrs.GetNamespace(), attrs.GetName())
+
+	if err != nil {
+		return nil
+	}
+
+	return expression.Normalize(object)
+}
+
+func toUnstructured(object runtime.Object) interface{} {
+
+	fields, err := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+
+	if err != nil {
+		return nil
+	}
+
+	return expression.Normalize(fields)
+}
@@ -0,0 +1,137 @@
+package admission
+
+import (
+	"testing"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"kubesphere.io/caddy-plugin/addmission/informer"
+)
+
+// testPolicySource loads document as the policies of a source named name
+func testPolicySource(t *testing.T, name string, document string) *PolicySource {
+
+	source := &PolicySource{Name: name, fetch: func() (string, map[string][]byte, error) {
+		return "1", map[string][]byte{name: []byte(document)}, nil
+	}}
+
+	if err := source.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	return source
+}
+
+func TestPolicyDecision(t *testing.T) {
+
+	// the member cluster east has the locked config map, the cluster of the gateway has none
+	server := objectServer(map[string]string{
+		"/api/v1/namespaces/demo/configmaps/settings": `{"metadata": {"name": "settings", "labels": {"locked": "true"}}}`,
+	})
+
+	defer server.Close()
+
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	east := &informer.Listers{Client: client}
+	host := &informer.Listers{}
+
+	locked := testPolicySource(t, "locked", `
+objects: [v1/configmaps]
+policies:
+- name: locked
+  effect: deny
+  verbs: [update, delete]
+  expression: object.metadata.labels.locked == 'true'
+`)
+
+	sources := testPolicySource(t, "b-ops", `
+policies:
+- name: ops-deny-secrets
+  effect: deny
+  resources: [secrets]
+  expression: "'ops' in user.groups"
+- name: ops-allow-pods
+  effect: allow
+  resources: [pods]
+  expression: "'ops' in user.groups"
+- name: broken
+  effect: deny
+  resources: [nodes]
+  expression: user.name + 1 == 1
+`)
+
+	// sources are evaluated by name, so a-allow is found before b-ops
+	allow := testPolicySource(t, "a-allow", `
+policies:
+- name: a-allow-pods
+  effect: allow
+  resources: [pods]
+  expression: "true"
+`)
+
+	tests := []struct {
+		name      string
+		policies  []*PolicySource
+		listers   *informer.Listers
+		groups    []string
+		verb      string
+		resource  string
+		effect    string
+		expected  string
+		attrsOnly bool
+	}{
+		{name: "deny", policies: []*PolicySource{sources}, groups: []string{"ops"}, verb: "get", resource: "secrets", effect: PolicyDeny, expected: "ops-deny-secrets"},
+		{name: "not matching", policies: []*PolicySource{sources}, groups: []string{"devs"}, verb: "get", resource: "secrets", effect: PolicyDeny},
+		{name: "allow", policies: []*PolicySource{sources}, groups: []string{"ops"}, verb: "get", resource: "pods", effect: PolicyAllow, expected: "ops-allow-pods"},
+		{name: "ordered by source name", policies: []*PolicySource{sources, allow}, groups: []string{"ops"}, verb: "get", resource: "pods", effect: PolicyAllow, expected: "a-allow-pods"},
+		{name: "failing expression denies", policies: []*PolicySource{sources}, verb: "get", resource: "nodes", effect: PolicyDeny, expected: "broken"},
+
+		// policies only apply on the sites they are configured on
+		{name: "another site", groups: []string{"ops"}, verb: "get", resource: "secrets", effect: PolicyDeny},
+		{name: "without a site", groups: []string{"ops"}, verb: "get", resource: "secrets", effect: PolicyDeny, attrsOnly: true},
+
+		// the object is read from the cluster of the request
+		{name: "object of the member cluster", policies: []*PolicySource{locked}, listers: east, verb: "update", resource: "configmaps", effect: PolicyDeny, expected: "locked"},
+		{name: "object of another cluster", policies: []*PolicySource{locked}, listers: host, verb: "update", resource: "configmaps", effect: PolicyDeny},
+	}
+
+	for _, test := range tests {
+
+		var attrs authorizer.Attributes = authorizer.AttributesRecord{
+			User:            &user.DefaultInfo{Name: "alice", Groups: test.groups},
+			Verb:            test.verb,
+			Namespace:       "demo",
+			APIVersion:      "v1",
+			Resource:        test.resource,
+			Name:            "settings",
+			ResourceRequest: true,
+		}
+
+		if !test.attrsOnly {
+			listers := test.listers
+
+			if listers == nil {
+				listers = host
+			}
+
+			attrs = requestAttributes{Attributes: attrs, listers: listers, policies: test.policies}
+		}
+
+		name := ""
+
+		if policy := policyDecision(attrs, test.effect); policy != nil {
+			name = policy.Name
+		}
+
+		if name != test.expected {
+			t.Errorf("%s: expected policy %q but got %q", test.name, test.expected, name)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package admission
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"kubesphere.io/caddy-plugin/addmission/informer"
+)
+
+// NamespaceSelectorRule grants Rules to Subjects in every namespace whose labels match Selector,
+// without a RoleBinding per namespace
+type NamespaceSelectorRule struct {
+	Selector labels.Selector
+	Subjects []v1.Subject
+	Rules    []v1.PolicyRule
+}
+
+// NewNamespaceSelectorRule parses
+//
+//	<selector> <subject>[,<subject>...] <verb>[,<verb>...] <resource>[,<resource>...]
+//
+// a subject is user:<name>, group:<name> or serviceaccount:[<namespace>:]<name>, a service account
+// without namespace is looked up in the requested namespace. A resource is resource[.group][/subresource]
+// as kubectl writes it, * grants every resource of every group.
+func NewNamespaceSelectorRule(selector string, subjects string, verbs string, resources string) (NamespaceSelectorRule, error) {
+
+	rule := NamespaceSelectorRule{}
+
+	parsedSelector, err := labels.Parse(selector)
+
+	if err != nil {
+		return rule, fmt.Errorf("namespace selector %s: %v", selector, err)
+	}
+
+	if parsedSelector.Empty() {
+		return rule, fmt.Errorf("namespace selector %s selects every namespace", selector)
+	}
+
+	rule.Selector = parsedSelector
+
+	for _, subject := range splitList(subjects) {
+		parsedSubject, err := parseSubject(subject)
+
+		if err != nil {
+			return rule, err
+		}
+
+		rule.Subjects = append(rule.Subjects, parsedSubject)
+	}
+
+	// one PolicyRule per API group
+	groups := make(map[string]int)
+
+	for _, resource := range splitList(resources) {
+
+		group, resource := parseResource(resource)
+
+		i, ok := groups[group]
+
+		if !ok {
+			i = len(rule.Rules)
+			groups[group] = i
+			rule.Rules = append(rule.Rules, v1.PolicyRule{Verbs: splitList(verbs), APIGroups: []string{group}})
+		}
+
+		rule.Rules[i].Resources = append(rule.Rules[i].Resources, resource)
+	}
+
+	if len(rule.Subjects) == 0 || len(rule.Rules) == 0 || len(rule.Rules[0].Verbs) == 0 {
+		return rule, fmt.Errorf("namespace selector %s needs subjects, verbs and resources", selector)
+	}
+
+	return rule, nil
+}
+
+func parseSubject(subject string) (v1.Subject, error) {
+
+	parts := strings.SplitN(subject, ":", 2)
+
+	if len(parts) != 2 || parts[1] == "" {
+		return v1.Subject{}, fmt.Errorf("invalid subject %s", subject)
+	}
+
+	switch parts[0] {
+	case "user":
+		return v1.Subject{Kind: v1.UserKind, APIGroup: v1.GroupName, Name: parts[1]}, nil
+	case "group":
+		return v1.Subject{Kind: v1.GroupKind, APIGroup: v1.GroupName, Name: parts[1]}, nil
+	case "serviceaccount":
+		if i := strings.Index(parts[1], ":"); i >= 0 {
+			return v1.Subject{Kind: v1.ServiceAccountKind, Namespace: parts[1][:i], Name: parts[1][i+1:]}, nil
+		}
+		return v1.Subject{Kind: v1.ServiceAccountKind, Name: parts[1]}, nil
+	}
+
+	return v1.Subject{}, fmt.Errorf("invalid subject kind %s", parts[0])
+}
+
+func parseResource(resource string) (string, string) {
+
+	if resource == v1.ResourceAll {
+		return v1.APIGroupAll, v1.ResourceAll
+	}
+
+	subresource := ""
+
+	if i := strings.Index(resource, "/"); i >= 0 {
+		resource, subresource = resource[:i], resource[i:]
+	}
+
+	group := ""
+
+	if i := strings.Index(resource, "."); i >= 0 {
+		resource, group = resource[:i], resource[i+1:]
+	}
+
+	return group, resource + subresource
+}
+
+func splitList(list string) []string {
+
+	values := make([]string, 0)
+
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// selectorBindings presents the selector rules matching the labels of namespace as bindings in it
+func selectorBindings(listers *informer.Listers, rules []NamespaceSelectorRule, namespace string) ([]binding, error) {
+
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	if listers.Namespaces == nil {
+		return nil, fmt.Errorf("namespace selector rules need the namespace cache")
+	}
+
+	ns, err := listers.Namespaces.Get(namespace)
+
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := make([]binding, 0)
+
+	for _, rule := range rules {
+		if rule.Selector.Matches(labels.Set(ns.Labels)) {
+			bindings = append(bindings, binding{Kind: "NamespaceSelector", Name: rule.Selector.String(), Namespace: namespace, Subjects: rule.Subjects, Rules: rule.Rules})
+		}
+	}
+
+	return bindings, nil
+}
+
+func selectorValidate(attrs authorizer.Attributes) (bool, error) {
+
+	bindings, err := selectorBindings(listersFor(attrs), selectorRulesFor(attrs), attrs.GetNamespace())
+
+	if err != nil {
+		return false, err
+	}
+
+	return bindingsValidate(bindings, attrs)
+}
@@ -0,0 +1,175 @@
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+const (
+	authorizationGroup       = "authorization.k8s.io"
+	selfSubjectRulesReviews  = "selfsubjectrulesreviews"
+	selfSubjectAccessReviews = "selfsubjectaccessreviews"
+)
+
+func isSelfReview(attrs authorizer.Attributes) bool {
+	return attrs.IsResourceRequest() &&
+		attrs.GetAPIGroup() == authorizationGroup &&
+		(attrs.GetAPIVersion() == "v1" || attrs.GetAPIVersion() == "v1beta1") &&
+		attrs.GetVerb() == "create" &&
+		(attrs.GetResource() == selfSubjectRulesReviews || attrs.GetResource() == selfSubjectAccessReviews)
+}
+
+// serveSelfReview answers SelfSubjectRulesReview and SelfSubjectAccessReview for the authenticated user
+// from the same evaluator that enforces access. v1beta1 shares the wire format of v1 for these kinds.
+func serveSelfReview(w http.ResponseWriter, r *http.Request, attrs authorizer.Attributes) (int, error) {
+
+	typeMeta := metav1.TypeMeta{APIVersion: authorizationGroup + "/" + attrs.GetAPIVersion()}
+
+	switch attrs.GetResource() {
+	case selfSubjectRulesReviews:
+		review := &authorizationv1.SelfSubjectRulesReview{}
+
+		if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		typeMeta.Kind = "SelfSubjectRulesReview"
+		review.TypeMeta = typeMeta
+		review.Status = rulesReview(attrs, review.Spec.Namespace)
+
+		return WriteJSON(w, http.StatusCreated, review)
+	default:
+		review := &authorizationv1.SelfSubjectAccessReview{}
+
+		if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		typeMeta.Kind = "SelfSubjectAccessReview"
+		review.TypeMeta = typeMeta
+		review.Status = accessReview(attrs, review.Spec)
+
+		return WriteJSON(w, http.StatusCreated, review)
+	}
+}
+
+func accessReview(attrs authorizer.Attributes, spec authorizationv1.SelfSubjectAccessReviewSpec) authorizationv1.SubjectAccessReviewStatus {
+
+	record := authorizer.AttributesRecord{User: attrs.GetUser()}
+
+	switch {
+	case spec.ResourceAttributes != nil:
+		record.ResourceRequest = true
+		record.Verb = spec.ResourceAttributes.Verb
+		record.Namespace = spec.ResourceAttributes.Namespace
+		record.APIGroup = spec.ResourceAttributes.Group
+		record.APIVersion = spec.ResourceAttributes.Version
+		record.Resource = spec.ResourceAttributes.Resource
+		record.Subresource = spec.ResourceAttributes.Subresource
+		record.Name = spec.ResourceAttributes.Name
+	case spec.NonResourceAttributes != nil:
+		record.Verb = spec.NonResourceAttributes.Verb
+		record.Path = spec.NonResourceAttributes.Path
+	default:
+		return authorizationv1.SubjectAccessReviewStatus{EvaluationError: "resourceAttributes or nonResourceAttributes required"}
+	}
+
+	permitted, err := admissionValidate(withCluster(attrs, record))
+
+	if err != nil {
+		return authorizationv1.SubjectAccessReviewStatus{EvaluationError: err.Error()}
+	}
+
+	if permitted {
+		return authorizationv1.SubjectAccessReviewStatus{Allowed: true}
+	}
+
+	return authorizationv1.SubjectAccessReviewStatus{Reason: "permission undefined"}
+}
+
+// rulesReview lists the rules granted to the user cluster wide and in namespace, the review is
+// incomplete when expression policies of the site may change the decision
+func rulesReview(attrs authorizer.Attributes, namespace string) authorizationv1.SubjectRulesReviewStatus {
+
+	status := authorizationv1.SubjectRulesReviewStatus{
+		ResourceRules:    make([]authorizationv1.ResourceRule, 0),
+		NonResourceRules: make([]authorizationv1.NonResourceRule, 0),
+	}
+
+	listers := listersFor(attrs)
+	workspace := namespaceWorkspace(listers, namespace)
+
+	for _, rule := range openAPIRules {
+		if rule.Resource == "" {
+			continue
+		}
+
+		resourceRule := authorizationv1.ResourceRule{Verbs: []string{rule.Verb}, APIGroups: []string{v1.APIGroupAll}, Resources: []string{rule.Resource}}
+
+		if rule.WorkspaceMember {
+			if member, err := isWorkspaceMember(listers, attrs.GetUser(), workspace); err != nil || !member {
+				continue
+			}
+			resourceRule.ResourceNames = []string{workspace}
+		}
+
+		status.ResourceRules = append(status.ResourceRules, resourceRule)
+	}
+
+	bindings, errs := applicableBindings(attrs, namespace, workspace)
+
+	// active break-glass grants of the user in the cluster
+	if usr := attrs.GetUser(); usr != nil {
+		for _, breakGlass := range breakGlassFor(attrs) {
+			if grant, ok := breakGlass.activeGrant(clusterOf(attrs), usr.GetName()); ok {
+				bindings = append(bindings, grant.binding(listers))
+			}
+		}
+	}
+
+	// expression policies are evaluated per request and can not be listed as rules
+	for _, source := range policySourcesFor(attrs) {
+		if policies, _ := source.current(); len(policies) > 0 {
+			errs = append(errs, fmt.Sprintf("%d expression policies of %s may deny or allow requests beyond these rules", len(policies), source.Name))
+		}
+	}
+
+	for _, binding := range bindings {
+
+		if !binding.appliesTo(attrs.GetUser()) {
+			continue
+		}
+
+		rules, err := binding.rules()
+
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s %s: %v", binding.Kind, binding.Name, err))
+			continue
+		}
+
+		for _, rule := range rules {
+			if len(rule.Resources) > 0 {
+				status.ResourceRules = append(status.ResourceRules, authorizationv1.ResourceRule{
+					Verbs: rule.Verbs, APIGroups: rule.APIGroups, Resources: rule.Resources, ResourceNames: rule.ResourceNames})
+			}
+			if len(rule.NonResourceURLs) > 0 {
+				status.NonResourceRules = append(status.NonResourceRules, authorizationv1.NonResourceRule{
+					Verbs: rule.Verbs, NonResourceURLs: rule.NonResourceURLs})
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		status.Incomplete = true
+		status.EvaluationError = strings.Join(errs, "; ")
+	}
+
+	return status
+}
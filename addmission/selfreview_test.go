@@ -0,0 +1,73 @@
+package admission
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+func TestRulesReview(t *testing.T) {
+
+	listers := testListers(&v1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "pod-reader"}, Rules: podReader})
+
+	breakGlass, err := NewBreakGlass("/break-glass", "pod-reader", time.Hour, []string{"user:alice"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	breakGlass.grants["\x00alice"] = &breakGlassGrant{User: "alice", ClusterRole: "pod-reader", Reason: "INC-1", Granted: now, ExpiresAt: now.Add(time.Minute)}
+
+	deny := testPolicySource(t, "deny", `
+policies:
+- name: deny-pods
+  effect: deny
+  resources: [pods]
+  expression: "true"
+`)
+
+	tests := []struct {
+		name       string
+		user       string
+		policies   []*PolicySource
+		pods       bool
+		incomplete bool
+	}{
+		{name: "break-glass grant", user: "alice", pods: true},
+		{name: "without a grant", user: "bob"},
+		{name: "expression policies", user: "alice", policies: []*PolicySource{deny}, pods: true, incomplete: true},
+	}
+
+	for _, test := range tests {
+
+		attrs := requestAttributes{
+			Attributes: authorizer.AttributesRecord{User: &user.DefaultInfo{Name: test.user}},
+			listers:    listers,
+			breakGlass: []*BreakGlass{breakGlass},
+			policies:   test.policies,
+		}
+
+		status := rulesReview(attrs, "demo")
+
+		pods := false
+
+		for _, rule := range status.ResourceRules {
+			if len(rule.Resources) == 1 && rule.Resources[0] == "pods" {
+				pods = true
+			}
+		}
+
+		if pods != test.pods {
+			t.Errorf("%s: expected the pods rule %v but got %v", test.name, test.pods, pods)
+		}
+
+		if status.Incomplete != test.incomplete {
+			t.Errorf("%s: expected incomplete %v but got %v: %s", test.name, test.incomplete, status.Incomplete, status.EvaluationError)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package admission
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+const (
+	CheckPrivileged     = "privileged"
+	CheckHostPath       = "host_path"
+	CheckHostNamespaces = "host_namespaces"
+)
+
+// the apiserver rejects larger request bodies as well
+const maxAdmissionBody = 3 * 1024 * 1024
+
+const webhookTimeout = 10 * time.Second
+
+// resources carrying a pod template, built-in checks apply to them unless resources are configured
+var podTemplateResources = []string{"pods", "deployments", "statefulsets", "daemonsets", "replicasets", "replicationcontrollers", "jobs", "cronjobs"}
+
+// ValidatingHook rejects create, update and patch requests on Resources, or * for every resource,
+// by a built-in check or a local AdmissionReview webhook
+type ValidatingHook struct {
+	Name      string
+	Resources []string
+	check     func(request *AdmissionRequest, object map[string]interface{}) (*metav1.Status, error)
+}
+
+// NewValidatingCheck is one of the built-in checks on pod specs
+func NewValidatingCheck(name string, resources []string) (*ValidatingHook, error) {
+
+	if len(resources) == 0 {
+		resources = podTemplateResources
+	}
+
+	hook := &ValidatingHook{Name: name, Resources: resources}
+
+	switch name {
+	case CheckPrivileged:
+		hook.check = podSpecCheck(denyPrivileged)
+	case CheckHostPath:
+		hook.check = podSpecCheck(denyHostPath)
+	case CheckHostNamespaces:
+		hook.check = podSpecCheck(denyHostNamespaces)
+	default:
+		return nil, fmt.Errorf("unknown validating check %s", name)
+	}
+
+	return hook, nil
+}
+
+// NewValidatingWebhook posts an AdmissionReview to url, requests are rejected when it cannot be reached
+func NewValidatingWebhook(url string, resources []string) (*ValidatingHook, error) {
+
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("invalid webhook url %s", url)
+	}
+
+	if len(resources) == 0 {
+		resources = []string{"*"}
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+
+	return &ValidatingHook{Name: url, Resources: resources, check: func(request *AdmissionRequest, object map[string]interface{}) (*metav1.Status, error) {
+
+		response, err := callWebhook(client, url, request)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if response.Allowed {
+			return nil, nil
+		}
+
+		if response.Result == nil {
+			response.Result = &metav1.Status{}
+		}
+
+		return response.Result, nil
+	}}, nil
+}
+
+func (h *ValidatingHook) matches(attrs authorizer.Attributes) bool {
+	return hasString(h.Resources, "*") || hasString(h.Resources, attrs.GetResource())
+}
+
+func callWebhook(client *http.Client, url string, request *AdmissionRequest) (*AdmissionResponse, error) {
+
+	review := AdmissionReview{TypeMeta: metav1.TypeMeta{APIVersion: admissionReviewVersion, Kind: "AdmissionReview"}, Request: request}
+
+	data, err := json.Marshal(review)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+
+	if err != nil {
+		return nil, fmt.Errorf("admission webhook %s: %v", url, err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admission webhook %s: %s", url, resp.Status)
+	}
+
+	result := AdmissionReview{}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("admission webhook %s: %v", url, err)
+	}
+
+	if result.Response == nil || result.Response.UID != request.UID {
+		return nil, fmt.Errorf("admission webhook %s: response does not answer request %s", url, request.UID)
+	}
+
+	return result.Response, nil
+}
+
+// isAdmissionRequest reports whether attrs carry an object to admit
+func isAdmissionRequest(attrs authorizer.Attributes) bool {
+	switch attrs.GetVerb() {
+	case "create", "update", "patch":
+		return attrs.IsResourceRequest()
+	}
+	return false
+}
+
+// validate runs the matching hooks on the body of r, which is restored for the upstream.
+// A denial or a failing hook answers with a Status and returns written true.
+func validate(w http.ResponseWriter, r *http.Request, attrs authorizer.Attributes, hooks []*ValidatingHook) (bool, error) {
+
+	matching := make([]*ValidatingHook, 0)
+
+	for _, hook := range hooks {
+		if hook.matches(attrs) {
+			matching = append(matching, hook)
+		}
+	}
+
+	if len(matching) == 0 {
+		return false, nil
+	}
+
+	request, object, status := admissionRequest(r, attrs)
+
+	if status != nil {
+		return true, writeStatus(w, status)
+	}
+
+	for _, hook := range matching {
+
+		denied, err := hook.check(request, object)
+
+		if err != nil {
+			return true, writeStatus(w, &errors.NewInternalError(err).ErrStatus)
+		}
+
+		if denied != nil {
+			message := fmt.Sprintf("admission %s denied the request", hook.Name)
+
+			if denied.Message != "" {
+				message = message + ": " + denied.Message
+			}
+
+			status := errors.NewForbidden(schema.GroupResource{Group: attrs.GetAPIGroup(), Resource: attrs.GetResource()}, attrs.GetName(), fmt.Errorf("%s", message)).ErrStatus
+
+			if denied.Code != 0 {
+				status.Code = denied.Code
+			}
+
+			return true, writeStatus(w, &status)
+		}
+	}
+
+	return false, nil
+}
+
+// admissionRequest reads the JSON or YAML body of r into an AdmissionRequest. A patch carries the
+// merge patch as a partial object under the UPDATE operation, JSON patches can not be inspected.
+func admissionRequest(r *http.Request, attrs authorizer.Attributes) (*AdmissionRequest, map[string]interface{}, *metav1.Status) {
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAdmissionBody+1))
+
+	if err != nil {
+		return nil, nil, &errors.NewBadRequest(err.Error()).ErrStatus
+	}
+
+	if len(body) > maxAdmissionBody {
+		return nil, nil, &metav1.Status{Status: metav1.StatusFailure, Code: http.StatusRequestEntityTooLarge, Message: "request body exceeds 3MB"}
+	}
+
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "application/json", "application/merge-patch+json", "application/strategic-merge-patch+json":
+	case "application/yaml":
+		if body, err = yaml.ToJSON(body); err != nil {
+			return nil, nil, &errors.NewBadRequest(err.Error()).ErrStatus
+		}
+	default:
+		return nil, nil, &metav1.Status{Status: metav1.StatusFailure, Code: http.StatusUnsupportedMediaType, Reason: metav1.StatusReasonUnsupportedMediaType,
+			Message: fmt.Sprintf("the body of %s requests on %s is admitted as JSON or YAML, not %s", attrs.GetVerb(), attrs.GetResource(), mediaType)}
+	}
+
+	object := make(map[string]interface{})
+
+	if err := utiljson.Unmarshal(body, &object); err != nil {
+		return nil, nil, &errors.NewBadRequest(err.Error()).ErrStatus
+	}
+
+	request := &AdmissionRequest{
+		UID:         uuid.NewUUID(),
+		Resource:    metav1.GroupVersionResource{Group: attrs.GetAPIGroup(), Version: attrs.GetAPIVersion(), Resource: attrs.GetResource()},
+		SubResource: attrs.GetSubresource(),
+		Name:        attrs.GetName(),
+		Namespace:   attrs.GetNamespace(),
+		Operation:   OperationUpdate,
+		Object:      runtime.RawExtension{Raw: body},
+	}
+
+	if attrs.GetVerb() == "create" {
+		request.Operation = OperationCreate
+	}
+
+	if gvk := (&unstructured.Unstructured{Object: object}).GroupVersionKind(); !gvk.Empty() {
+		request.Kind = metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind}
+	}
+
+	if r.URL.Query().Get("dryRun") != "" {
+		dryRun := true
+		request.DryRun = &dryRun
+	}
+
+	if usr := attrs.GetUser(); usr != nil {
+		request.UserInfo = authenticationv1.UserInfo{Username: usr.GetName(), UID: usr.GetUID(), Groups: usr.GetGroups()}
+
+		if len(usr.GetExtra()) > 0 {
+			request.UserInfo.Extra = make(map[string]authenticationv1.ExtraValue)
+			for key, values := range usr.GetExtra() {
+				request.UserInfo.Extra[key] = values
+			}
+		}
+	}
+
+	return request, object, nil
+}
+
+// writeStatus answers with status like the apiserver does
+func writeStatus(w http.ResponseWriter, status *metav1.Status) error {
+
+	status.Kind = "Status"
+	status.APIVersion = "v1"
+
+	code := int(status.Code)
+
+	if code == 0 {
+		code = http.StatusInternalServerError
+	}
+
+	_, err := WriteJSON(w, code, status)
+
+	return err
+}
+
+// podSpecCheck applies deny to the pod spec of a pod, a pod template or a cron job, a partial
+// object checks the fields it sets
+func podSpecCheck(deny func(spec *corev1.PodSpec) string) func(*AdmissionRequest, map[string]interface{}) (*metav1.Status, error) {
+	return func(request *AdmissionRequest, object map[string]interface{}) (*metav1.Status, error) {
+
+		path := []string{"spec", "template", "spec"}
+
+		switch request.Resource.Resource {
+		case "pods":
+			path = []string{"spec"}
+		case "cronjobs":
+			path = []string{"spec", "jobTemplate", "spec", "template", "spec"}
+		}
+
+		fields, found, err := unstructured.NestedMap(object, path...)
+
+		if err != nil || !found {
+			return nil, err
+		}
+
+		spec := &corev1.PodSpec{}
+
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(fields, spec); err != nil {
+			return nil, err
+		}
+
+		if reason := deny(spec); reason != "" {
+			return &metav1.Status{Message: reason}, nil
+		}
+
+		return nil, nil
+	}
+}
+
+func denyPrivileged(spec *corev1.PodSpec) string {
+	for _, container := range append(spec.InitContainers, spec.Containers...) {
+		if context := container.SecurityContext; context != nil && context.Privileged != nil && *context.Privileged {
+			return fmt.Sprintf("container %s is privileged", container.Name)
+		}
+	}
+	return ""
+}
+
+func denyHostPath(spec *corev1.PodSpec) string {
+	for _, volume := range spec.Volumes {
+		if volume.HostPath != nil {
+			return fmt.Sprintf("volume %s mounts host path %s", volume.Name, volume.HostPath.Path)
+		}
+	}
+	return ""
+}
+
+func denyHostNamespaces(spec *corev1.PodSpec) string {
+	switch {
+	case spec.HostNetwork:
+		return "hostNetwork is set"
+	case spec.HostPID:
+		return "hostPID is set"
+	case spec.HostIPC:
+		return "hostIPC is set"
+	}
+	return ""
+}
@@ -0,0 +1,96 @@
+package admission
+
+import (
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"kubesphere.io/caddy-plugin/addmission/informer"
+)
+
+// workspaceLabel on a Namespace names the workspace it belongs to, on a ClusterRoleBinding
+// it names the workspace the binding is granted in
+const workspaceLabel = "kubesphere.io/workspace"
+
+// namespaceWorkspace is the workspace of namespace, empty when it has none or is unknown
+func namespaceWorkspace(listers *informer.Listers, namespace string) string {
+
+	if namespace == "" || listers.Namespaces == nil {
+		return ""
+	}
+
+	ns, err := listers.Namespaces.Get(namespace)
+
+	if err != nil {
+		return ""
+	}
+
+	return ns.Labels[workspaceLabel]
+}
+
+// requestWorkspace is the workspace requested by name or the workspace of the requested namespace
+func requestWorkspace(attrs authorizer.Attributes) string {
+
+	if attrs.IsResourceRequest() && attrs.GetResource() == "workspaces" {
+		return attrs.GetName()
+	}
+
+	return namespaceWorkspace(listersFor(attrs), attrs.GetNamespace())
+}
+
+// workspaceBindings lists the ClusterRoleBindings labelled with workspace
+func workspaceBindings(listers *informer.Listers, workspace string) ([]binding, error) {
+
+	selector := labels.SelectorFromSet(labels.Set{workspaceLabel: workspace})
+
+	clusterRoleBindings, err := listers.ClusterRoleBindings.List(selector)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := make([]binding, 0, len(clusterRoleBindings))
+
+	for _, clusterRoleBinding := range clusterRoleBindings {
+		expiresAt, expired := bindingExpiry(clusterRoleBinding.Annotations)
+		if expired {
+			continue
+		}
+		bindings = append(bindings, binding{Kind: "ClusterRoleBinding", Name: clusterRoleBinding.Name, Workspace: workspace, ExpiresAt: expiresAt, RoleRef: clusterRoleBinding.RoleRef, Subjects: clusterRoleBinding.Subjects, listers: listers})
+	}
+
+	return bindings, nil
+}
+
+// workspaceValidate grants the workspace roles of the user in the workspace and its namespaces
+func workspaceValidate(attrs authorizer.Attributes, workspace string) (bool, error) {
+
+	bindings, err := workspaceBindings(listersFor(attrs), workspace)
+
+	if err != nil {
+		return false, err
+	}
+
+	return bindingsValidate(bindings, attrs)
+}
+
+// isWorkspaceMember reports whether any workspace role is bound to usr
+func isWorkspaceMember(listers *informer.Listers, usr user.Info, workspace string) (bool, error) {
+
+	if usr == nil || workspace == "" {
+		return false, nil
+	}
+
+	bindings, err := workspaceBindings(listers, workspace)
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, binding := range bindings {
+		if binding.appliesTo(usr) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -7,7 +7,10 @@ import (
 	"github.com/mholt/caddy/caddyhttp/httpserver"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
 	"k8s.io/apiserver/pkg/endpoints/request"
+	admission "kubesphere.io/caddy-plugin/addmission"
+	"kubesphere.io/caddy-plugin/addmission/informer"
 	"net/http"
 	"strconv"
 	"strings"
@@ -19,8 +22,35 @@ type Auth struct {
 }
 
 type Rule struct {
-	Path         string
-	ExceptedPath []string
+	Path             string
+	ExceptedPath     []string
+	Impersonation    bool
+	RateLimits       []*RateLimit
+	Lockout          *Lockout
+	LockoutAdminPath string
+	// LockoutName shares Lockout with the sites naming the same lockout
+	LockoutName string
+	// UpstreamCredentials, the first matching path applies, end with basic auth for Jenkins
+	UpstreamCredentials []*UpstreamCredential
+	SigningKeys         *SigningKeys
+	JWKSPath            string
+	// StripHeaders are identity header patterns removed from client requests
+	StripHeaders  []string
+	RemoteHeaders bool
+	TokenSources  []TokenSource
+	Sessions      *Sessions
+	CSRF          *CSRF
+	// VerificationKeys of user tokens, JWT_SECRET unless jwt_keys is set
+	VerificationKeys *VerificationKeys
+	// Introspection authenticates opaque tokens
+	Introspection *Introspection
+	// APIKeys and Htpasswd authenticate automation with static credentials
+	APIKeys              *Credentials
+	Htpasswd             *Credentials
+	CredentialsAdminPath string
+	// Client reads the key and credential Secrets, from the cluster of the kubeconfig, api_server and
+	// token_file options of the block, else of KUBECONFIG or the cluster the gateway runs in
+	Client informer.ClientConfig
 }
 
 type User struct {
@@ -30,9 +60,6 @@ type User struct {
 	Extra    *map[string]interface{} `json:"extra,omitempty"`
 }
 
-const jenkinsAPIBase = "/apis/jenkins.kubesphere.io"
-const jenkinsAPIRedirect = "/job"
-
 // TODO nonResourceRequest support
 
 var requestInfoFactory = request.RequestInfoFactory{
@@ -43,6 +70,15 @@ func (h *Auth) ServeHTTP(resp http.ResponseWriter, req *http.Request) (int, erro
 
 	for _, r := range h.Rules {
 
+		if r.JWKSPath != "" && req.URL.Path == r.JWKSPath {
+			return r.SigningKeys.serveJWKS(resp)
+		}
+
+		// excepted paths are proxied too, so sanitize before the exception applies
+		if httpserver.Path(req.URL.Path).Matches(r.Path) {
+			stripIdentityHeaders(req.Header, r.StripHeaders, r.Impersonation)
+		}
+
 		skip := false
 
 		for _, path := range r.ExceptedPath {
@@ -53,29 +89,142 @@ func (h *Auth) ServeHTTP(resp http.ResponseWriter, req *http.Request) (int, erro
 		}
 
 		if skip {
+			// impersonation headers are only kept for requests whose impersonation is checked below
+			if r.Impersonation && httpserver.Path(req.URL.Path).Matches(r.Path) {
+				stripIdentityHeaders(req.Header, []string{"Impersonate-*"}, false)
+			}
 			continue
 		}
 
 		if httpserver.Path(req.URL.Path).Matches(r.Path) {
 
-			uToken, err := extractToken(req)
+			var uToken string
+			var source TokenSource
+			var sessionID string
+			var err error
+
+			if r.Sessions != nil {
+				if session, ok := r.Sessions.session(req); ok {
+					uToken = session.Token
+					sessionID = session.ID
+					source = TokenSource{Kind: TokenFromSession, Name: r.Sessions.CookieName}
+				}
+			}
+
+			if uToken == "" {
+				uToken, source, err = extractToken(req, r.TokenSources)
+			}
+
+			if err != nil && r.Htpasswd != nil {
+				if username, password, ok := req.BasicAuth(); ok {
+					uToken, source, err = password, TokenSource{Kind: TokenFromBasic, Name: username}, nil
+				}
+			}
 
 			if err != nil {
 				return handleUnauthorized(resp, req, err.Error()), nil
 			}
 
-			token, err := validate(uToken)
+			if r.Lockout != nil {
+				if banned, retryAfter := r.Lockout.banned(req, uToken); banned {
+					return handleTooManyRequests(resp, retryAfter), nil
+				}
+			}
+
+			token, err := r.authenticate(req, uToken, source)
+
+			// an unreachable or failing introspection endpoint is not the fault of the token
+			if isIntrospectionUnavailable(err) {
+				return http.StatusServiceUnavailable, err
+			}
 
 			if err != nil {
+				if r.Lockout != nil {
+					r.Lockout.failed(req, uToken)
+				}
 				return handleUnauthorized(resp, req, err.Error()), nil
 			}
 
-			r, err := injectContext(uToken, token, req)
+			if r.Lockout != nil {
+				r.Lockout.succeeded(req, uToken)
+			}
+
+			injected, err := injectContext(token, req)
 
 			if err != nil {
 				return handleUnauthorized(resp, req, err.Error()), nil
 			} else {
-				req = r
+				req = injected
+			}
+
+			if r.CSRF != nil {
+				if err := r.CSRF.check(resp, req, source); err != nil {
+					return handleCSRFFailure(resp, err)
+				}
+			}
+
+			for _, limit := range r.RateLimits {
+				if ok, retryAfter := limit.reserve(req); !ok {
+					return handleTooManyRequests(resp, retryAfter), nil
+				}
+			}
+
+			if r.Impersonation && impersonationRequested(req) {
+				impersonated, err := impersonate(req)
+
+				if _, denied := err.(*impersonationDenied); denied {
+					return handleForbidden(resp, req, err.Error()), nil
+				}
+
+				// the permissions could not be checked, e.g. the RBAC caches are not started
+				if err != nil {
+					return http.StatusInternalServerError, err
+				}
+
+				req = impersonated
+			}
+
+			if r.RemoteHeaders {
+				if usr, ok := request.UserFrom(req.Context()); ok {
+					setRemoteHeaders(req.Header, usr)
+				}
+			}
+
+			if r.LockoutAdminPath != "" && httpserver.Path(req.URL.Path).Matches(r.LockoutAdminPath) {
+				return r.Lockout.serveAdmin(resp, req)
+			}
+
+			if r.CredentialsAdminPath != "" && httpserver.Path(req.URL.Path).Matches(r.CredentialsAdminPath) {
+				return serveCredentialsAdmin(resp, req, r.APIKeys, r.Htpasswd)
+			}
+
+			if r.Sessions != nil {
+				switch {
+				case r.Sessions.LoginPath != "" && req.URL.Path == r.Sessions.LoginPath:
+					return r.Sessions.login(resp, req, uToken)
+				case r.Sessions.LogoutPath != "" && req.URL.Path == r.Sessions.LogoutPath:
+					return r.Sessions.logout(resp, req, sessionID)
+				case r.Sessions.AdminPath != "" && httpserver.Path(req.URL.Path).Matches(r.Sessions.AdminPath):
+					return r.Sessions.serveAdmin(resp, req)
+				}
+			}
+
+			claims, _ := token.Claims.(jwt.MapClaims)
+
+			if r.staticCredential(uToken, source) {
+				stripCredentials(req, r.TokenSources)
+				req.Header.Del("Authorization")
+				uToken = ""
+			}
+
+			err = injectUpstreamCredential(r.UpstreamCredentials, req, uToken, claims, r.TokenSources)
+
+			if _, denied := err.(*upstreamCredentialDenied); denied {
+				return handleForbidden(resp, req, err.Error()), nil
+			}
+
+			if err != nil {
+				return http.StatusInternalServerError, err
 			}
 		}
 	}
@@ -83,7 +232,7 @@ func (h *Auth) ServeHTTP(resp http.ResponseWriter, req *http.Request) (int, erro
 	return h.Next.ServeHTTP(resp, req)
 }
 
-func injectContext(uToken string, token *jwt.Token, req *http.Request) (*http.Request, error) {
+func injectContext(token *jwt.Token, req *http.Request) (*http.Request, error) {
 
 	payLoad, ok := token.Claims.(jwt.MapClaims)
 
@@ -91,18 +240,11 @@ func injectContext(uToken string, token *jwt.Token, req *http.Request) (*http.Re
 		return nil, errors.New("invalid payload")
 	}
 
-	for header := range req.Header {
-		if strings.HasPrefix(header, "X-Token-") {
-			req.Header.Del(header)
-		}
-	}
-
 	usr := &user.DefaultInfo{}
 
 	username, ok := payLoad["username"].(string)
 
 	if ok && username != "" {
-		req.Header.Set("X-Token-Username", username)
 		usr.Name = username
 	}
 
@@ -111,26 +253,31 @@ func injectContext(uToken string, token *jwt.Token, req *http.Request) (*http.Re
 	if uid != nil {
 		switch uid.(type) {
 		case int:
-			req.Header.Set("X-Token-UID", strconv.Itoa(uid.(int)))
 			usr.UID = strconv.Itoa(uid.(int))
 			break
 		case string:
-			req.Header.Set("X-Token-UID", uid.(string))
 			usr.UID = uid.(string)
 			break
 		}
 	}
 
-	groups, ok := payLoad["groups"].([]string)
-	if ok && len(groups) > 0 {
-		req.Header.Set("X-Token-Groups", strings.Join(groups, ","))
+	switch groups := payLoad["groups"].(type) {
+	case []string:
 		usr.Groups = groups
+	case []interface{}:
+		for _, group := range groups {
+			if g, ok := group.(string); ok {
+				usr.Groups = append(usr.Groups, g)
+			}
+		}
 	}
 
-	if httpserver.Path(req.URL.Path).Matches(jenkinsAPIBase) || httpserver.Path(req.URL.Path).Matches(jenkinsAPIRedirect) {
-		req.SetBasicAuth(username, uToken)
+	if scope, ok := payLoad["scope"].(string); ok && scope != "" {
+		usr.Extra = map[string][]string{"scopes": strings.Fields(scope)}
 	}
 
+	setTokenHeaders(req, usr)
+
 	//TODO extra
 	//extra := payLoad["extra"]
 
@@ -151,13 +298,82 @@ func injectContext(uToken string, token *jwt.Token, req *http.Request) (*http.Re
 	return req, nil
 }
 
-func validate(uToken string) (*jwt.Token, error) {
+// setTokenHeaders replaces the X-Token-* headers with the identity of usr
+func setTokenHeaders(req *http.Request, usr user.Info) {
+
+	for header := range req.Header {
+		if strings.HasPrefix(header, "X-Token-") {
+			req.Header.Del(header)
+		}
+	}
+
+	if usr.GetName() != "" {
+		req.Header.Set("X-Token-Username", usr.GetName())
+	}
+
+	if usr.GetUID() != "" {
+		req.Header.Set("X-Token-UID", usr.GetUID())
+	}
+
+	if len(usr.GetGroups()) > 0 {
+		req.Header.Set("X-Token-Groups", strings.Join(usr.GetGroups(), ","))
+	}
+}
+
+// authenticate checks basic credentials against htpasswd, tokens against the API keys,
+// opaque tokens with introspection and the other tokens with the verification keys
+func (r Rule) authenticate(req *http.Request, uToken string, source TokenSource) (*jwt.Token, error) {
+
+	if source.Kind == TokenFromBasic {
+		entry, err := r.Htpasswd.verifyPassword(source.Name, uToken)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return r.Htpasswd.token(entry, req, uToken)
+	}
+
+	if r.APIKeys != nil {
+		if entry, ok := r.APIKeys.lookupAPIKey(uToken); ok {
+			return r.APIKeys.token(entry, req, uToken)
+		}
+	}
+
+	if r.Introspection != nil && len(uToken) > 0 && isOpaqueToken(uToken) {
+		return r.Introspection.validate(uToken)
+	}
+
+	return validate(r.VerificationKeys, uToken)
+}
+
+// staticCredential reports whether the request authenticated with a password or an API key
+func (r Rule) staticCredential(uToken string, source TokenSource) bool {
+
+	if source.Kind == TokenFromBasic {
+		return true
+	}
+
+	if r.APIKeys == nil {
+		return false
+	}
+
+	_, ok := r.APIKeys.lookupAPIKey(uToken)
+
+	return ok
+}
+
+func validate(keys *VerificationKeys, uToken string) (*jwt.Token, error) {
 
 	if len(uToken) == 0 {
 		return nil, fmt.Errorf("token length is zero")
 	}
 
-	token, err := jwt.Parse(uToken, ProvideKey)
+	if keys == nil {
+		return nil, fmt.Errorf("no verification keys")
+	}
+
+	token, err := keys.validate(uToken)
 
 	if err != nil {
 		return nil, err
@@ -172,23 +388,30 @@ func handleUnauthorized(w http.ResponseWriter, r *http.Request, reason string) i
 	return http.StatusUnauthorized
 }
 
-func extractToken(r *http.Request) (string, error) {
+func handleForbidden(w http.ResponseWriter, r *http.Request, reason string) int {
+	message := fmt.Sprintf("Forbidden,%s", reason)
+	w.Header().Add("WWW-Authenticate", message)
+	return http.StatusForbidden
+}
+
+// authorizeAdmin requires the user of req to be granted the request path as a non-resource URL
+func authorizeAdmin(req *http.Request) error {
+
+	usr, ok := request.UserFrom(req.Context())
 
-	jwtHeader := strings.Split(r.Header.Get("Authorization"), " ")
-	if jwtHeader[0] == "Bearer" && len(jwtHeader) == 2 {
-		return jwtHeader[1], nil
+	if !ok {
+		return fmt.Errorf("no authenticated user")
 	}
 
-	jwtCookie, err := r.Cookie("token")
+	permitted, err := admission.Authorize(authorizer.AttributesRecord{User: usr, Verb: strings.ToLower(req.Method), Path: req.URL.Path})
 
-	if err == nil {
-		return jwtCookie.Value, nil
+	if err != nil {
+		return err
 	}
 
-	jwtQuery := r.URL.Query().Get("token")
-	if jwtQuery != "" {
-		return jwtQuery, nil
+	if !permitted {
+		return fmt.Errorf("user %q cannot access %s", usr.GetName(), req.URL.Path)
 	}
 
-	return "", fmt.Errorf("no token found")
+	return nil
 }
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func TestInjectContextGroups(t *testing.T) {
+
+	secret := []byte("secret")
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"username": "alice", "groups": []string{"admins", "devs"}}).SignedString(secret)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// verified tokens decode the claim from JSON
+	parsed, err := validate(staticVerificationKeys(secret), signed)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		token    *jwt.Token
+		expected []string
+	}{
+		{name: "verified token", token: parsed, expected: []string{"admins", "devs"}},
+		{name: "built in process", token: &jwt.Token{Claims: jwt.MapClaims{"username": "alice", "groups": []string{"ops"}}}, expected: []string{"ops"}},
+		{name: "members that are not strings", token: &jwt.Token{Claims: jwt.MapClaims{"username": "alice", "groups": []interface{}{"ops", 1, nil}}}, expected: []string{"ops"}},
+		{name: "not a list", token: &jwt.Token{Claims: jwt.MapClaims{"username": "alice", "groups": "ops"}}},
+		{name: "no groups", token: &jwt.Token{Claims: jwt.MapClaims{"username": "alice"}}},
+	}
+
+	for _, test := range tests {
+
+		injected, err := injectContext(test.token, httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil))
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		usr, ok := request.UserFrom(injected.Context())
+
+		if !ok {
+			t.Errorf("%s: no user in the request context", test.name)
+			continue
+		}
+
+		if groups := usr.GetGroups(); !reflect.DeepEqual(groups, test.expected) {
+			t.Errorf("%s: expected groups %v but got %v", test.name, test.expected, groups)
+		}
+	}
+}
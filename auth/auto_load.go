@@ -2,17 +2,20 @@ package auth
 
 import (
 	"fmt"
-	"github.com/dgrijalva/jwt-go"
 	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"golang.org/x/time/rate"
+	admission "kubesphere.io/caddy-plugin/addmission"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// EnvSecret is the verification key of the sites without jwt_keys
 const EnvSecret = "JWT_SECRET"
 
-var Secret []byte
-
 func init() {
 	caddy.RegisterPlugin("auth", caddy.Plugin{
 		ServerType: "http",
@@ -20,31 +23,47 @@ func init() {
 	})
 }
 
-func ProvideKey(token *jwt.Token) (interface{}, error) {
-	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
-		return Secret, nil
-	} else {
-		return nil, fmt.Errorf("expect token signed with HMAC but got %v", token.Header["alg"])
-	}
-}
-
 func Setup(c *caddy.Controller) error {
 
-	secret := os.Getenv(EnvSecret)
+	// stops the key and credential pollers of this configuration
+	stop := make(chan struct{})
 
-	if len(secret) == 0 {
-		return fmt.Errorf("environment variable %s not set", EnvSecret)
+	rules, err := parse(c, stop)
+
+	if err != nil {
+		close(stop)
+		return err
 	}
 
-	Secret = []byte(secret)
+	for i := range rules {
+		if rules[i].VerificationKeys != nil {
+			continue
+		}
 
-	rules, err := parse(c)
+		secret := os.Getenv(EnvSecret)
 
-	if err != nil {
-		return err
+		// sites authenticating only with other credentials need no JWT secret
+		if len(secret) == 0 && (rules[i].APIKeys != nil || rules[i].Htpasswd != nil || rules[i].Introspection != nil) {
+			continue
+		}
+
+		if len(secret) == 0 {
+			close(stop)
+			releaseSharedLockouts(rules)
+			return fmt.Errorf("environment variable %s not set", EnvSecret)
+		}
+
+		rules[i].VerificationKeys = staticVerificationKeys([]byte(secret))
 	}
 
+	c.OnShutdown(func() error {
+		close(stop)
+		releaseSharedLockouts(rules)
+		return nil
+	})
+
 	c.OnStartup(func() error {
+		startSharedLockouts()
 		fmt.Println("JWT Auth middleware is initiated")
 		return nil
 	})
@@ -55,12 +74,13 @@ func Setup(c *caddy.Controller) error {
 
 	return nil
 }
-func parse(c *caddy.Controller) ([]Rule, error) {
+func parse(c *caddy.Controller, stop <-chan struct{}) ([]Rule, error) {
 	rules := make([]Rule, 0)
 
 	for c.Next() {
 		args := c.RemainingArgs()
-		rule := Rule{ExceptedPath: make([]string, 0)}
+		rule := Rule{ExceptedPath: make([]string, 0), StripHeaders: defaultIdentityHeaders, TokenSources: defaultTokenSources()}
+		secrets := NewKeySecrets(rule.Client)
 		switch len(args) {
 		case 0:
 			for c.NextBlock() {
@@ -92,11 +112,383 @@ func parse(c *caddy.Controller) ([]Rule, error) {
 						return nil, c.ArgErr()
 					}
 					break
+				case "impersonation":
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+
+					rule.Impersonation = true
+					break
+				case "ratelimit":
+					args := c.RemainingArgs()
+
+					if len(args) != 3 {
+						return nil, c.ArgErr()
+					}
+
+					limit, err := strconv.ParseFloat(args[1], 64)
+
+					if err != nil {
+						return nil, c.Errf("invalid rate %s: %v", args[1], err)
+					}
+
+					burst, err := strconv.Atoi(args[2])
+
+					if err != nil {
+						return nil, c.Errf("invalid burst %s: %v", args[2], err)
+					}
+
+					rateLimit, err := NewRateLimit(args[0], rate.Limit(limit), burst)
+
+					if err != nil {
+						return nil, c.Err(err.Error())
+					}
+
+					rule.RateLimits = append(rule.RateLimits, rateLimit)
+					break
+				case "lockout":
+					args := c.RemainingArgs()
+
+					if len(args) != 4 && len(args) != 5 {
+						return nil, c.ArgErr()
+					}
+
+					threshold, err := strconv.Atoi(args[0])
+
+					if err != nil {
+						return nil, c.Errf("invalid lockout threshold %s: %v", args[0], err)
+					}
+
+					durations := make([]time.Duration, 3)
+
+					for i, arg := range args[1:4] {
+						if durations[i], err = time.ParseDuration(arg); err != nil {
+							return nil, c.Errf("invalid lockout duration %s: %v", arg, err)
+						}
+					}
+
+					lockout, err := NewLockout(threshold, durations[0], durations[1], durations[2])
+
+					if err != nil {
+						return nil, c.Err(err.Error())
+					}
+
+					// shared once the block is parsed, the client IP header is part of its definition
+					if len(args) == 5 {
+						rule.LockoutName = args[4]
+					}
+
+					rule.Lockout = lockout
+					break
+				case "lockout_client_ip":
+					if rule.Lockout == nil {
+						return nil, c.Err("lockout_client_ip requires lockout")
+					}
+
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+
+					rule.Lockout.ClientIPHeader = http.CanonicalHeaderKey(c.Val())
+
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					break
+				case "lockout_admin":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+
+					rule.LockoutAdminPath = c.Val()
+
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					break
+				case "upstream_credentials":
+					args := c.RemainingArgs()
+
+					if len(args) < 2 {
+						return nil, c.ArgErr()
+					}
+
+					credential, err := NewUpstreamCredential(args[0], args[1:])
+
+					if err != nil {
+						return nil, c.Err(err.Error())
+					}
+
+					rule.UpstreamCredentials = append(rule.UpstreamCredentials, credential)
+					break
+				case "signing_key":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+
+					keys, err := NewSigningKeys(c.Val(), secrets, stop)
+
+					if err != nil {
+						return nil, c.Err(err.Error())
+					}
+
+					rule.SigningKeys = keys
+
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					break
+				case "strip_headers":
+					args := c.RemainingArgs()
+
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+
+					if len(args) == 1 && args[0] == "off" {
+						rule.StripHeaders = []string{}
+					} else {
+						rule.StripHeaders = append(append([]string{}, rule.StripHeaders...), args...)
+					}
+					break
+				case "token_sources":
+					args := c.RemainingArgs()
+
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+
+					rule.TokenSources = make([]TokenSource, 0, len(args))
+
+					for _, arg := range args {
+						source, err := ParseTokenSource(arg)
+
+						if err != nil {
+							return nil, c.Err(err.Error())
+						}
+
+						rule.TokenSources = append(rule.TokenSources, source)
+					}
+					break
+				case "session":
+					args := c.RemainingArgs()
+
+					if len(args) != 3 {
+						return nil, c.ArgErr()
+					}
+
+					idle, err := time.ParseDuration(args[1])
+
+					if err != nil {
+						return nil, c.Errf("invalid session idle timeout %s: %v", args[1], err)
+					}
+
+					lifetime, err := time.ParseDuration(args[2])
+
+					if err != nil {
+						return nil, c.Errf("invalid session lifetime %s: %v", args[2], err)
+					}
+
+					sessions, err := NewSessions(args[0], idle, lifetime)
+
+					if err != nil {
+						return nil, c.Err(err.Error())
+					}
+
+					rule.Sessions = sessions
+					break
+				case "session_cookie", "session_login", "session_logout", "session_admin":
+					directive := c.Val()
+
+					if rule.Sessions == nil {
+						return nil, c.Errf("%s requires session", directive)
+					}
+
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+
+					switch directive {
+					case "session_cookie":
+						rule.Sessions.CookieName = c.Val()
+					case "session_login":
+						rule.Sessions.LoginPath = c.Val()
+					case "session_logout":
+						rule.Sessions.LogoutPath = c.Val()
+					case "session_admin":
+						rule.Sessions.AdminPath = c.Val()
+					}
+
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					break
+				case "csrf":
+					args := c.RemainingArgs()
+
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+
+					csrf, err := NewCSRF(args[0], args[1:])
+
+					if err != nil {
+						return nil, c.Err(err.Error())
+					}
+
+					rule.CSRF = csrf
+					break
+				case "csrf_except":
+					if rule.CSRF == nil {
+						return nil, c.Err("csrf_except requires csrf")
+					}
+
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+
+					rule.CSRF.ExceptedPath = strings.Split(c.Val(), ",")
+
+					for i := 0; i < len(rule.CSRF.ExceptedPath); i++ {
+						rule.CSRF.ExceptedPath[i] = strings.TrimSpace(rule.CSRF.ExceptedPath[i])
+					}
+
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					break
+				case "remote_headers":
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+
+					rule.RemoteHeaders = true
+					break
+				case "jwt_keys":
+					args := c.RemainingArgs()
+
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+
+					keys, err := NewVerificationKeys(args, secrets, stop)
+
+					if err != nil {
+						return nil, c.Err(err.Error())
+					}
+
+					rule.VerificationKeys = keys
+					break
+				case "introspection":
+					args := c.RemainingArgs()
+
+					if len(args) != 3 {
+						return nil, c.ArgErr()
+					}
+
+					clientSecret := os.Getenv(args[2])
+
+					if len(clientSecret) == 0 {
+						return nil, c.Errf("environment variable %s not set", args[2])
+					}
+
+					introspection, err := NewIntrospection(args[0], args[1], clientSecret)
+
+					if err != nil {
+						return nil, c.Err(err.Error())
+					}
+
+					rule.Introspection = introspection
+					break
+				case "api_keys", "htpasswd":
+					kind := c.Val()
+
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+
+					credentials, err := NewCredentials(kind, c.Val(), secrets, stop)
+
+					if err != nil {
+						return nil, c.Err(err.Error())
+					}
+
+					if kind == CredentialsAPIKeys {
+						rule.APIKeys = credentials
+					} else {
+						rule.Htpasswd = credentials
+					}
+
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					break
+				case "kubeconfig", "kube_context", "api_server", "ca_file", "token_file", "qps", "burst", "resync", "user_agent":
+					option := c.Val()
+
+					if err := admission.ParseClientOption(c, &rule.Client); err != nil {
+						return nil, err
+					}
+
+					if !secrets.configure(rule.Client) {
+						return nil, c.Errf("%s must precede the keys and credentials read from Secrets", option)
+					}
+					break
+				case "credentials_admin":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+
+					rule.CredentialsAdminPath = c.Val()
+
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					break
+				case "jwks":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+
+					rule.JWKSPath = c.Val()
+
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					break
+				}
+			}
+
+			for _, credential := range rule.UpstreamCredentials {
+				if credential.Kind == CredentialExchange {
+					if rule.SigningKeys == nil {
+						return nil, c.Err("exchange credentials require signing_key")
+					}
+					credential.keys = rule.SigningKeys
+				}
+			}
+
+			if rule.JWKSPath != "" && rule.SigningKeys == nil {
+				return nil, c.Err("jwks requires signing_key")
+			}
+			if rule.LockoutAdminPath != "" && rule.Lockout == nil {
+				return nil, c.Err("lockout_admin requires lockout")
+			}
+			if rule.LockoutName != "" {
+				lockout, err := SharedLockout(rule.LockoutName, rule.Lockout)
+
+				if err != nil {
+					return nil, c.Err(err.Error())
 				}
+
+				rule.Lockout = lockout
+			}
+			if rule.CredentialsAdminPath != "" && rule.APIKeys == nil && rule.Htpasswd == nil {
+				return nil, c.Err("credentials_admin requires api_keys or htpasswd")
 			}
 		case 1:
+			// appended once below like block rules, with the default upstream credentials
 			rule.Path = args[0]
-			rules = append(rules, rule)
 			if c.NextBlock() {
 				return nil, c.ArgErr()
 			}
@@ -104,6 +496,9 @@ func parse(c *caddy.Controller) ([]Rule, error) {
 			return nil, c.ArgErr()
 		}
 
+		// the first matching path wins, so configured credentials can still override the Jenkins paths
+		rule.UpstreamCredentials = append(rule.UpstreamCredentials, defaultUpstreamCredentials()...)
+
 		rules = append(rules, rule)
 	}
 	return rules, nil
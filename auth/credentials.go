@@ -0,0 +1,376 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ghodss/yaml"
+	"golang.org/x/crypto/bcrypt"
+	"k8s.io/apimachinery/pkg/util/wait"
+	admission "kubesphere.io/caddy-plugin/addmission"
+)
+
+const (
+	CredentialsAPIKeys  = "api_keys"
+	CredentialsHtpasswd = "htpasswd"
+)
+
+// TokenFromBasic is the password of basic credentials, Name is the user
+const TokenFromBasic = "basic"
+
+const apiKeyHashPrefix = "sha256:"
+
+// CredentialsPollInterval how often API key and htpasswd sources are checked for changes
+const CredentialsPollInterval = time.Minute
+
+// Credentials are the API keys or htpasswd users of a file or Secret, reloaded on change.
+// API keys are presented as bearer tokens and stored as sha256:<hex>, htpasswd users use
+// basic auth with bcrypt hashes.
+type Credentials struct {
+	Kind     string
+	source   string
+	secrets  *KeySecrets
+	lock     sync.RWMutex
+	raw      []byte
+	entries  map[string]*credential
+	verified map[string]string
+	lastUsed map[string]time.Time
+}
+
+// credential maps an API key or htpasswd user to the user it authenticates as. Expires and
+// Paths, the path prefixes it is valid for, are optional.
+type credential struct {
+	ID      string     `json:"id"`
+	Hash    string     `json:"hash"`
+	User    string     `json:"user"`
+	UID     string     `json:"uid,omitempty"`
+	Groups  []string   `json:"groups,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Paths   []string   `json:"paths,omitempty"`
+}
+
+// apiKeyDocument is the YAML or JSON of an API key file or Secret key
+type apiKeyDocument struct {
+	Keys []*credential `json:"keys"`
+}
+
+// NewCredentials loads the API keys or htpasswd users of a file or secret://<namespace>/<name>/<key>.
+// Htpasswd lines are user:bcrypt-hash[:groups[:expires[:paths]]] with comma separated groups
+// and paths and an RFC 3339 expiry. The source is reloaded until stop is closed.
+func NewCredentials(kind string, source string, secrets *KeySecrets, stop <-chan struct{}) (*Credentials, error) {
+
+	if kind != CredentialsAPIKeys && kind != CredentialsHtpasswd {
+		return nil, fmt.Errorf("unknown credentials kind %s", kind)
+	}
+
+	credentials := &Credentials{Kind: kind, source: source, secrets: secrets, lastUsed: make(map[string]time.Time)}
+
+	if err := credentials.reload(); err != nil {
+		return nil, fmt.Errorf("%s %s: %v", kind, source, err)
+	}
+
+	go wait.Until(func() {
+		if err := credentials.reload(); err != nil {
+			log.Printf("%s %s could not be reloaded: %v", kind, source, err)
+		}
+	}, CredentialsPollInterval, stop)
+
+	return credentials, nil
+}
+
+func (c *Credentials) reload() error {
+
+	raw, err := readKeySource(c.source, c.secrets)
+
+	if err != nil {
+		return err
+	}
+
+	c.lock.RLock()
+	unchanged := bytes.Equal(raw, c.raw)
+	c.lock.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	var entries map[string]*credential
+
+	if c.Kind == CredentialsAPIKeys {
+		entries, err = parseAPIKeys(raw)
+	} else {
+		entries, err = parseHtpasswd(raw)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.raw = raw
+	c.entries = entries
+	c.verified = make(map[string]string)
+
+	log.Printf("%s %s loaded: %d credentials", c.Kind, c.source, len(entries))
+
+	return nil
+}
+
+// parseAPIKeys indexes the keys by hash
+func parseAPIKeys(raw []byte) (map[string]*credential, error) {
+
+	document := apiKeyDocument{}
+
+	if err := yaml.Unmarshal(raw, &document); err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]*credential, len(document.Keys))
+
+	for _, key := range document.Keys {
+
+		if key.ID == "" || key.User == "" {
+			return nil, fmt.Errorf("api keys require an id and a user")
+		}
+
+		if !strings.HasPrefix(key.Hash, apiKeyHashPrefix) {
+			return nil, fmt.Errorf("api key %s: expect hash %s<hex>", key.ID, apiKeyHashPrefix)
+		}
+
+		hash, err := hex.DecodeString(strings.TrimPrefix(key.Hash, apiKeyHashPrefix))
+
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("api key %s: invalid sha256 hash", key.ID)
+		}
+
+		entries[hex.EncodeToString(hash)] = key
+	}
+
+	return entries, nil
+}
+
+// parseHtpasswd indexes the users by name
+func parseHtpasswd(raw []byte) (map[string]*credential, error) {
+
+	entries := make(map[string]*credential)
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Split(text, ":")
+
+		if len(fields) < 2 || len(fields) > 5 || fields[0] == "" {
+			return nil, fmt.Errorf("line %d: expect user:hash[:groups[:expires[:paths]]]", line)
+		}
+
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("line %d: only bcrypt hashes are supported", line)
+		}
+
+		entry := &credential{ID: fields[0], Hash: fields[1], User: fields[0]}
+
+		if len(fields) > 2 && fields[2] != "" {
+			entry.Groups = strings.Split(fields[2], ",")
+		}
+
+		if len(fields) > 3 && fields[3] != "" {
+			expires, err := time.Parse(time.RFC3339, fields[3])
+
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+
+			entry.Expires = &expires
+		}
+
+		if len(fields) > 4 && fields[4] != "" {
+			entry.Paths = strings.Split(fields[4], ",")
+		}
+
+		entries[entry.User] = entry
+	}
+
+	return entries, scanner.Err()
+}
+
+// lookupAPIKey returns the API key matching uToken
+func (c *Credentials) lookupAPIKey(uToken string) (*credential, bool) {
+
+	sum := sha256.Sum256([]byte(uToken))
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	entry, ok := c.entries[hex.EncodeToString(sum[:])]
+
+	return entry, ok
+}
+
+// verifyPassword checks the bcrypt hash of username, successful checks are remembered until the next reload
+func (c *Credentials) verifyPassword(username string, password string) (*credential, error) {
+
+	sum := sha256.Sum256([]byte(password))
+	digest := hex.EncodeToString(sum[:])
+
+	c.lock.RLock()
+	entry, ok := c.entries[username]
+	verified := c.verified[username]
+	c.lock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("invalid username or password")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(verified), []byte(digest)) == 1 {
+		return entry, nil
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(entry.Hash), []byte(password)); err != nil {
+		return nil, fmt.Errorf("invalid username or password")
+	}
+
+	c.lock.Lock()
+	if c.entries[username] == entry {
+		c.verified[username] = digest
+	}
+	c.lock.Unlock()
+
+	return entry, nil
+}
+
+// token checks the expiry and paths of entry, records its use and returns the claims of its user
+func (c *Credentials) token(entry *credential, req *http.Request, uToken string) (*jwt.Token, error) {
+
+	now := time.Now()
+
+	if entry.Expires != nil && !now.Before(*entry.Expires) {
+		return nil, fmt.Errorf("credential %s is expired", entry.ID)
+	}
+
+	if len(entry.Paths) > 0 {
+		allowed := false
+
+		for _, prefix := range entry.Paths {
+			if pathWithin(req.URL.Path, prefix) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return nil, fmt.Errorf("credential %s is not valid for %s", entry.ID, req.URL.Path)
+		}
+	}
+
+	c.lock.Lock()
+	c.lastUsed[entry.ID] = now
+	c.lock.Unlock()
+
+	claims := jwt.MapClaims{"username": entry.User, "credential": entry.ID}
+
+	if entry.UID != "" {
+		claims["uid"] = entry.UID
+	}
+
+	if len(entry.Groups) > 0 {
+		claims["groups"] = entry.Groups
+	}
+
+	return &jwt.Token{Raw: uToken, Claims: claims, Valid: true}, nil
+}
+
+// pathWithin matches prefix on path segment boundaries of the cleaned requestPath, /ns/ci matches
+// /ns/ci and /ns/ci/jobs but not /ns/ci-prod
+func pathWithin(requestPath string, prefix string) bool {
+
+	requestPath = path.Clean(requestPath)
+
+	if !strings.HasPrefix(requestPath, prefix) {
+		return false
+	}
+
+	return len(requestPath) == len(prefix) || strings.HasSuffix(prefix, "/") || requestPath[len(prefix)] == '/'
+}
+
+// credentialView hides the hash
+type credentialView struct {
+	Kind     string     `json:"kind"`
+	ID       string     `json:"id"`
+	User     string     `json:"user"`
+	Groups   []string   `json:"groups,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Paths    []string   `json:"paths,omitempty"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+}
+
+func (c *Credentials) views() []credentialView {
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	views := make([]credentialView, 0, len(c.entries))
+
+	for _, entry := range c.entries {
+		view := credentialView{Kind: c.Kind, ID: entry.ID, User: entry.User, Groups: entry.Groups, Expires: entry.Expires, Paths: entry.Paths}
+
+		if lastUsed, ok := c.lastUsed[entry.ID]; ok {
+			view.LastUsed = &lastUsed
+		}
+
+		views = append(views, view)
+	}
+
+	return views
+}
+
+// serveCredentialsAdmin lists the API keys and htpasswd users of a rule with the time they were last used
+func serveCredentialsAdmin(w http.ResponseWriter, req *http.Request, credentials ...*Credentials) (int, error) {
+
+	if err := authorizeAdmin(req); err != nil {
+		return handleForbidden(w, req, err.Error()), nil
+	}
+
+	if req.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	views := make([]credentialView, 0)
+
+	for _, c := range credentials {
+		if c != nil {
+			views = append(views, c.views()...)
+		}
+	}
+
+	sort.Slice(views, func(i, j int) bool {
+		if views[i].Kind != views[j].Kind {
+			return views[i].Kind < views[j].Kind
+		}
+		return views[i].ID < views[j].ID
+	})
+
+	return admission.WriteJSON(w, http.StatusOK, views)
+}
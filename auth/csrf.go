@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	admission "kubesphere.io/caddy-plugin/addmission"
+)
+
+const (
+	// CSRFOrigin requires the Origin, or the Referer without it, to be the requested host or an allowed origin
+	CSRFOrigin = "origin"
+	// CSRFDoubleSubmit requires the csrf header to repeat the value of the csrf cookie issued by the gateway
+	CSRFDoubleSubmit = "double_submit"
+)
+
+const (
+	csrfCookie = "csrf_token"
+	csrfHeader = "X-Csrf-Token"
+)
+
+// CSRF protects mutating requests whose credential was sent automatically by the browser
+type CSRF struct {
+	Mode           string
+	AllowedOrigins []string
+	ExceptedPath   []string
+}
+
+func NewCSRF(mode string, allowedOrigins []string) (*CSRF, error) {
+
+	switch mode {
+	case CSRFOrigin, CSRFDoubleSubmit:
+	default:
+		return nil, fmt.Errorf("unknown csrf mode %s", mode)
+	}
+
+	for i, origin := range allowedOrigins {
+		allowedOrigins[i] = strings.TrimSuffix(strings.ToLower(origin), "/")
+	}
+
+	return &CSRF{Mode: mode, AllowedOrigins: allowedOrigins, ExceptedPath: make([]string, 0)}, nil
+}
+
+// check verifies requests authenticated by a cookie or a session, safe methods
+// pass and receive the double submit cookie when they do not have one yet
+func (c *CSRF) check(w http.ResponseWriter, req *http.Request, source TokenSource) error {
+
+	if source.Kind != TokenFromCookie && source.Kind != TokenFromSession {
+		return nil
+	}
+
+	for _, path := range c.ExceptedPath {
+		if httpserver.Path(req.URL.Path).Matches(path) {
+			return nil
+		}
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		if c.Mode == CSRFDoubleSubmit {
+			if cookie, err := req.Cookie(csrfCookie); err != nil || cookie.Value == "" {
+				return issueCSRFCookie(w, req)
+			}
+		}
+		return nil
+	}
+
+	if c.Mode == CSRFDoubleSubmit {
+		cookie, err := req.Cookie(csrfCookie)
+
+		if err != nil || cookie.Value == "" {
+			return fmt.Errorf("missing %s cookie", csrfCookie)
+		}
+
+		if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(req.Header.Get(csrfHeader))) != 1 {
+			return fmt.Errorf("%s header does not match the %s cookie", csrfHeader, csrfCookie)
+		}
+
+		return nil
+	}
+
+	origin := req.Header.Get("Origin")
+
+	if origin == "" || origin == "null" {
+		referer, err := url.Parse(req.Header.Get("Referer"))
+
+		if err != nil || referer.Host == "" {
+			return fmt.Errorf("missing Origin and Referer")
+		}
+
+		origin = referer.Scheme + "://" + referer.Host
+	}
+
+	originURL, err := url.Parse(origin)
+
+	if err != nil {
+		return fmt.Errorf("invalid origin %s", origin)
+	}
+
+	if strings.EqualFold(originURL.Host, req.Host) {
+		return nil
+	}
+
+	for _, allowed := range c.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("origin %s not allowed", origin)
+}
+
+func issueCSRFCookie(w http.ResponseWriter, req *http.Request) error {
+
+	value := make([]byte, 32)
+
+	if _, err := rand.Read(value); err != nil {
+		return err
+	}
+
+	// readable by scripts, which have to send it back in the csrf header
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: base64.RawURLEncoding.EncodeToString(value), Path: "/", Secure: req.TLS != nil})
+
+	return nil
+}
+
+// handleCSRFFailure writes a Forbidden Status like the apiserver does, the response is
+// complete so caddy must not write its own error page
+func handleCSRFFailure(w http.ResponseWriter, err error) (int, error) {
+
+	status := apierrors.NewForbidden(schema.GroupResource{}, "", fmt.Errorf("CSRF check failed: %v", err)).ErrStatus
+	status.Kind = "Status"
+	status.APIVersion = "v1"
+
+	if code, err := admission.WriteJSON(w, http.StatusForbidden, status); err != nil {
+		return code, err
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSRFCheck(t *testing.T) {
+
+	origin, err := NewCSRF(CSRFOrigin, []string{"https://Console.example.com/"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origin.ExceptedPath = []string{"/oauth/callback"}
+
+	doubleSubmit, err := NewCSRF(CSRFDoubleSubmit, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		csrf    *CSRF
+		method  string
+		path    string
+		source  string
+		headers map[string]string
+		cookie  string
+		err     string
+		issued  bool
+	}{
+		// only credentials sent by the browser are checked
+		{name: "header token", csrf: origin, method: http.MethodPost, source: TokenFromHeader},
+		{name: "excepted path", csrf: origin, method: http.MethodPost, path: "/oauth/callback", source: TokenFromCookie},
+		{name: "safe method", csrf: origin, method: http.MethodGet, source: TokenFromCookie},
+
+		{name: "same host", csrf: origin, method: http.MethodPost, source: TokenFromCookie, headers: map[string]string{"Origin": "https://gateway.example.com"}},
+		{name: "allowed origin", csrf: origin, method: http.MethodDelete, source: TokenFromSession, headers: map[string]string{"Origin": "https://console.example.com"}},
+		{name: "referer", csrf: origin, method: http.MethodPut, source: TokenFromCookie, headers: map[string]string{"Referer": "https://console.example.com/page"}},
+		{name: "foreign origin", csrf: origin, method: http.MethodPost, source: TokenFromCookie, headers: map[string]string{"Origin": "https://evil.example.com"}, err: "origin https://evil.example.com not allowed"},
+		{name: "null origin", csrf: origin, method: http.MethodPost, source: TokenFromCookie, headers: map[string]string{"Origin": "null"}, err: "missing Origin and Referer"},
+		{name: "no origin", csrf: origin, method: http.MethodPost, source: TokenFromSession, err: "missing Origin and Referer"},
+
+		{name: "issue cookie", csrf: doubleSubmit, method: http.MethodGet, source: TokenFromCookie, issued: true},
+		{name: "keep cookie", csrf: doubleSubmit, method: http.MethodGet, source: TokenFromCookie, cookie: "value"},
+		{name: "matching header", csrf: doubleSubmit, method: http.MethodPost, source: TokenFromCookie, cookie: "value", headers: map[string]string{csrfHeader: "value"}},
+		{name: "missing cookie", csrf: doubleSubmit, method: http.MethodPost, source: TokenFromCookie, headers: map[string]string{csrfHeader: "value"}, err: "missing csrf_token cookie"},
+		{name: "mismatching header", csrf: doubleSubmit, method: http.MethodPatch, source: TokenFromSession, cookie: "value", headers: map[string]string{csrfHeader: "other"}, err: "X-Csrf-Token header does not match the csrf_token cookie"},
+	}
+
+	for _, test := range tests {
+
+		path := test.path
+
+		if path == "" {
+			path = "/api/v1/namespaces"
+		}
+
+		req := httptest.NewRequest(test.method, "https://gateway.example.com"+path, nil)
+
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+
+		if test.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: csrfCookie, Value: test.cookie})
+		}
+
+		recorder := httptest.NewRecorder()
+
+		err := test.csrf.check(recorder, req, TokenSource{Kind: test.source})
+
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected error %q but got %v", test.name, test.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+
+		if issued := len(recorder.Result().Cookies()) > 0; issued != test.issued {
+			t.Errorf("%s: expected cookie issued %v but got %v", test.name, test.issued, issued)
+		}
+	}
+}
+
+func TestHandleCSRFFailure(t *testing.T) {
+
+	recorder := httptest.NewRecorder()
+
+	// the response is written, so caddy must not be handed an error status
+	if status, err := handleCSRFFailure(recorder, fmt.Errorf("missing Origin and Referer")); status != 0 || err != nil {
+		t.Errorf("expected 0 but got %d %v", status, err)
+	}
+
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expected %d but got %d", http.StatusForbidden, recorder.Code)
+	}
+
+	var status struct {
+		Kind    string `json:"kind"`
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	}
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Kind != "Status" || status.Reason != "Forbidden" || !strings.Contains(status.Message, "CSRF check failed: missing Origin and Referer") {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const (
+	remoteUserHeader        = "X-Remote-User"
+	remoteGroupHeader       = "X-Remote-Group"
+	remoteExtraHeaderPrefix = "X-Remote-Extra-"
+)
+
+// defaultIdentityHeaders are the header families upstreams commonly trust for identity,
+// a trailing * matches a prefix
+var defaultIdentityHeaders = []string{
+	"X-Token-*",
+	"X-Remote-*",
+	"Impersonate-*",
+	"X-Forwarded-User",
+	"X-Forwarded-Groups",
+	"X-Forwarded-Email",
+	"X-Forwarded-Preferred-Username",
+	"X-Auth-Request-*",
+	"X-Webauth-*",
+}
+
+// stripIdentityHeaders removes client supplied headers matching patterns, Impersonate-* is
+// kept for the impersonation step when requested, which removes it itself
+func stripIdentityHeaders(header http.Header, patterns []string, keepImpersonation bool) {
+
+	for name := range header {
+
+		if keepImpersonation && strings.HasPrefix(name, "Impersonate-") {
+			continue
+		}
+
+		for _, pattern := range patterns {
+			if headerMatches(name, pattern) {
+				header.Del(name)
+				break
+			}
+		}
+	}
+}
+
+func headerMatches(name, pattern string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(name, http.CanonicalHeaderKey(strings.TrimSuffix(pattern, "*")))
+	}
+	return name == http.CanonicalHeaderKey(pattern)
+}
+
+// setRemoteHeaders presents usr under the names of the kube-apiserver requestheader authenticator
+func setRemoteHeaders(header http.Header, usr user.Info) {
+
+	for name := range header {
+		if strings.HasPrefix(name, "X-Remote-") {
+			header.Del(name)
+		}
+	}
+
+	header.Set(remoteUserHeader, usr.GetName())
+
+	for _, group := range usr.GetGroups() {
+		header.Add(remoteGroupHeader, group)
+	}
+
+	for key, values := range usr.GetExtra() {
+		for _, value := range values {
+			header.Add(remoteExtraHeaderPrefix+url.PathEscape(key), value)
+		}
+	}
+}
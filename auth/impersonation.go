@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	admission "kubesphere.io/caddy-plugin/addmission"
+)
+
+const (
+	impersonateUserHeader        = "Impersonate-User"
+	impersonateGroupHeader       = "Impersonate-Group"
+	impersonateExtraHeaderPrefix = "Impersonate-Extra-"
+	impersonatorHeader           = "X-Token-Impersonator"
+)
+
+type impersonatorKey int
+
+// impersonationDenied is the error of a request that may not impersonate as asked, other errors
+// of impersonate are failures to check the permissions
+type impersonationDenied struct {
+	reason string
+}
+
+func (e *impersonationDenied) Error() string {
+	return e.reason
+}
+
+// ImpersonatorFrom returns the authenticated user of a request that impersonates another user
+func ImpersonatorFrom(ctx context.Context) (user.Info, bool) {
+	usr, ok := ctx.Value(impersonatorKey(0)).(user.Info)
+	return usr, ok
+}
+
+func impersonationRequested(req *http.Request) bool {
+	for header := range req.Header {
+		if strings.HasPrefix(header, "Impersonate-") {
+			return true
+		}
+	}
+	return false
+}
+
+// impersonate swaps the user of the request for the one named by the Impersonate-* headers,
+// the authenticated user needs the impersonate verb on every requested user, group and extra
+func impersonate(req *http.Request) (*http.Request, error) {
+
+	impersonator, ok := request.UserFrom(req.Context())
+
+	if !ok {
+		return nil, &impersonationDenied{reason: "no authenticated user"}
+	}
+
+	username := req.Header.Get(impersonateUserHeader)
+
+	if username == "" {
+		return nil, &impersonationDenied{reason: fmt.Sprintf("%s required when impersonating groups or extra", impersonateUserHeader)}
+	}
+
+	checks := make([]authorizer.AttributesRecord, 0)
+	impersonated := &user.DefaultInfo{Name: username, Extra: make(map[string][]string)}
+
+	if namespace, name, err := serviceaccount.SplitUsername(username); err == nil {
+		checks = append(checks, authorizer.AttributesRecord{Resource: "serviceaccounts", Namespace: namespace, Name: name})
+		impersonated.Groups = serviceaccount.MakeGroupNames(namespace)
+	} else {
+		checks = append(checks, authorizer.AttributesRecord{Resource: "users", Name: username})
+	}
+
+	for _, group := range req.Header[impersonateGroupHeader] {
+		checks = append(checks, authorizer.AttributesRecord{Resource: "groups", Name: group})
+		impersonated.Groups = append(impersonated.Groups, group)
+	}
+
+	for header, values := range req.Header {
+		if !strings.HasPrefix(header, impersonateExtraHeaderPrefix) {
+			continue
+		}
+
+		key := unescapeExtraKey(strings.ToLower(strings.TrimPrefix(header, impersonateExtraHeaderPrefix)))
+
+		for _, value := range values {
+			checks = append(checks, authorizer.AttributesRecord{APIGroup: "authentication.k8s.io", Resource: "userextras", Subresource: key, Name: value})
+			impersonated.Extra[key] = append(impersonated.Extra[key], value)
+		}
+	}
+
+	for _, check := range checks {
+		check.User = impersonator
+		check.Verb = "impersonate"
+		check.ResourceRequest = true
+
+		permitted, err := admission.Authorize(check)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !permitted {
+			return nil, &impersonationDenied{reason: fmt.Sprintf("user %q cannot impersonate %s %q", impersonator.GetName(), check.Resource, check.Name)}
+		}
+	}
+
+	if username != user.Anonymous && !hasString(impersonated.Groups, user.AllAuthenticated) {
+		impersonated.Groups = append(impersonated.Groups, user.AllAuthenticated)
+	}
+
+	for header := range req.Header {
+		if strings.HasPrefix(header, "Impersonate-") {
+			req.Header.Del(header)
+		}
+	}
+
+	setTokenHeaders(req, impersonated)
+	req.Header.Set(impersonatorHeader, impersonator.GetName())
+
+	log.Printf("user %q impersonates %q with groups %v on %s %s", impersonator.GetName(), impersonated.Name, impersonated.Groups, req.Method, req.URL.Path)
+
+	ctx := request.WithUser(req.Context(), impersonated)
+	ctx = context.WithValue(ctx, impersonatorKey(0), impersonator)
+
+	return req.WithContext(ctx), nil
+}
+
+// unescapeExtraKey decodes the percent encoded Impersonate-Extra-* key as the API server does,
+// e.g. Impersonate-Extra-Example.com%2fteam is the key example.com/team. Keys that are not
+// validly encoded are kept as sent.
+func unescapeExtraKey(encoded string) string {
+
+	key, err := url.PathUnescape(encoded)
+
+	if err != nil {
+		return encoded
+	}
+
+	return key
+}
+
+func hasString(slice []string, value string) bool {
+	for _, s := range slice {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
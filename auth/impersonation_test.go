@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	rbaclisters "k8s.io/client-go/listers/rbac/v1"
+	"k8s.io/client-go/tools/cache"
+	"kubesphere.io/caddy-plugin/addmission/informer"
+)
+
+// startTestCaches sets the shared RBAC caches to objects until the returned function is called
+func startTestCaches(objects ...interface{}) func() {
+
+	indexer := func() cache.Indexer {
+		return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	}
+
+	clusterRoleBindings, clusterRoles := indexer(), indexer()
+
+	for _, object := range objects {
+		switch object.(type) {
+		case *v1.ClusterRoleBinding:
+			clusterRoleBindings.Add(object)
+		case *v1.ClusterRole:
+			clusterRoles.Add(object)
+		}
+	}
+
+	informer.ClusterRoleBindingLister = rbaclisters.NewClusterRoleBindingLister(clusterRoleBindings)
+	informer.ClusterRoleLister = rbaclisters.NewClusterRoleLister(clusterRoles)
+	informer.RoleBindingLister = rbaclisters.NewRoleBindingLister(indexer())
+	informer.RoleLister = rbaclisters.NewRoleLister(indexer())
+
+	return func() {
+		informer.ClusterRoleBindingLister = nil
+		informer.ClusterRoleLister = nil
+		informer.RoleBindingLister = nil
+		informer.RoleLister = nil
+	}
+}
+
+func TestImpersonationStatus(t *testing.T) {
+
+	secret := []byte("secret")
+
+	uToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": "alice",
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	}).SignedString(secret)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Auth{
+		Rules: []Rule{{
+			Path:             "/",
+			TokenSources:     defaultTokenSources(),
+			VerificationKeys: staticVerificationKeys(secret),
+			Impersonation:    true,
+		}},
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+	}
+
+	objects := []interface{}{
+		&v1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "impersonate-bob"},
+			Rules:      []v1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"users"}, ResourceNames: []string{"bob"}, Verbs: []string{"impersonate"}}},
+		},
+		&v1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "alice-impersonates-bob"},
+			RoleRef:    v1.RoleRef{APIGroup: v1.GroupName, Kind: "ClusterRole", Name: "impersonate-bob"},
+			Subjects:   []v1.Subject{{Kind: v1.UserKind, APIGroup: v1.GroupName, Name: "alice"}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		started  bool
+		headers  map[string]string
+		expected int
+	}{
+		{name: "permitted", started: true, headers: map[string]string{"Impersonate-User": "bob"}, expected: http.StatusOK},
+		{name: "not permitted", started: true, headers: map[string]string{"Impersonate-User": "carol"}, expected: http.StatusForbidden},
+		{name: "groups without a user", started: true, headers: map[string]string{"Impersonate-Group": "admins"}, expected: http.StatusForbidden},
+
+		// the permissions can not be checked without the RBAC caches
+		{name: "caches not started", headers: map[string]string{"Impersonate-User": "bob"}, expected: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+
+		stop := func() {}
+
+		if test.started {
+			stop = startTestCaches(objects...)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+		req.Header.Set("Authorization", "Bearer "+uToken)
+
+		for header, value := range test.headers {
+			req.Header.Set(header, value)
+		}
+
+		status, _ := h.ServeHTTP(httptest.NewRecorder(), req)
+		stop()
+
+		if status != test.expected {
+			t.Errorf("%s: expected %d but got %d", test.name, test.expected, status)
+		}
+	}
+}
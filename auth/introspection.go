@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const introspectionTimeout = 10 * time.Second
+
+// introspection results kept at most, expired results are dropped first
+const maxIntrospectionCache = 10000
+
+// Introspection authenticates opaque tokens, which are not JWTs, by posting them to the
+// RFC 7662 endpoint of an OAuth server with the client credentials
+type Introspection struct {
+	Endpoint     string
+	ClientID     string
+	ClientSecret string
+	client       *http.Client
+	lock         sync.Mutex
+	cache        map[string]introspectionResult
+}
+
+// introspectionResponse are the fields of an introspection response mapped to the user
+type introspectionResponse struct {
+	Active   bool        `json:"active"`
+	Subject  string      `json:"sub"`
+	Username string      `json:"username"`
+	Scope    string      `json:"scope"`
+	Groups   interface{} `json:"groups"`
+	Expires  json.Number `json:"exp"`
+}
+
+// introspectionUnavailableError is a failure of the introspection endpoint, which says nothing
+// about the token
+type introspectionUnavailableError struct {
+	err error
+}
+
+func (e *introspectionUnavailableError) Error() string {
+	return fmt.Sprintf("token introspection failed: %v", e.err)
+}
+
+func isIntrospectionUnavailable(err error) bool {
+	_, ok := err.(*introspectionUnavailableError)
+	return ok
+}
+
+type introspectionResult struct {
+	claims  jwt.MapClaims
+	expires time.Time
+}
+
+// NewIntrospection authenticates as clientID with clientSecret, e.g. to http://127.0.0.1:8080/introspect
+func NewIntrospection(endpoint string, clientID string, clientSecret string) (*Introspection, error) {
+
+	parsed, err := url.Parse(endpoint)
+
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("introspection endpoint %s is not an http or https URL", endpoint)
+	}
+
+	return &Introspection{
+		Endpoint:     endpoint,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		client:       &http.Client{Timeout: introspectionTimeout},
+		cache:        make(map[string]introspectionResult),
+	}, nil
+}
+
+// validate returns the introspected token with the claims username, uid, groups and scope
+// next to the other members of the response. Active results are cached until they expire.
+func (i *Introspection) validate(uToken string) (*jwt.Token, error) {
+
+	sum := sha256.Sum256([]byte(uToken))
+	key := hex.EncodeToString(sum[:])
+
+	i.lock.Lock()
+	cached, ok := i.cache[key]
+	i.lock.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return &jwt.Token{Raw: uToken, Claims: cached.claims, Valid: true}, nil
+	}
+
+	claims, expires, err := i.introspect(uToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !expires.IsZero() {
+		i.store(key, introspectionResult{claims: claims, expires: expires})
+	}
+
+	return &jwt.Token{Raw: uToken, Claims: claims, Valid: true}, nil
+}
+
+func (i *Introspection) introspect(uToken string) (jwt.MapClaims, time.Time, error) {
+
+	form := url.Values{"token": {uToken}, "token_type_hint": {"access_token"}}
+
+	req, err := http.NewRequest(http.MethodPost, i.Endpoint, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(i.ClientID), url.QueryEscape(i.ClientSecret))
+
+	resp, err := i.client.Do(req)
+
+	if err != nil {
+		return nil, time.Time{}, &introspectionUnavailableError{err: err}
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	if err != nil {
+		return nil, time.Time{}, &introspectionUnavailableError{err: err}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, &introspectionUnavailableError{err: fmt.Errorf("%s", resp.Status)}
+	}
+
+	response := introspectionResponse{}
+
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, time.Time{}, &introspectionUnavailableError{err: err}
+	}
+
+	if !response.Active {
+		return nil, time.Time{}, fmt.Errorf("token is not active")
+	}
+
+	claims := jwt.MapClaims{}
+
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, time.Time{}, fmt.Errorf("token introspection failed: %v", err)
+	}
+
+	delete(claims, "groups")
+	claims["uid"] = response.Subject
+	claims["username"] = response.Username
+
+	if response.Username == "" {
+		claims["username"] = response.Subject
+	}
+
+	switch groups := response.Groups.(type) {
+	case string:
+		claims["groups"] = strings.Fields(groups)
+	case []interface{}:
+		claims["groups"] = groups
+	}
+
+	var expires time.Time
+
+	if response.Expires != "" {
+		exp, err := response.Expires.Int64()
+
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("token introspection failed: invalid exp %s", response.Expires)
+		}
+
+		expires = time.Unix(exp, 0)
+
+		if !time.Now().Before(expires) {
+			return nil, time.Time{}, fmt.Errorf("token is expired")
+		}
+	}
+
+	return claims, expires, nil
+}
+
+func (i *Introspection) store(key string, result introspectionResult) {
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if len(i.cache) >= maxIntrospectionCache {
+		now := time.Now()
+		for k, cached := range i.cache {
+			if !now.Before(cached.expires) {
+				delete(i.cache, k)
+			}
+		}
+	}
+
+	if len(i.cache) < maxIntrospectionCache {
+		i.cache[key] = result
+	}
+}
+
+// isOpaqueToken reports whether uToken is not a JWT
+func isOpaqueToken(uToken string) bool {
+	_, _, err := new(jwt.Parser).ParseUnverified(uToken, jwt.MapClaims{})
+	return err != nil
+}
@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// introspectionServer answers with the response of the posted token and counts the requests
+func introspectionServer(responses map[string]string, calls *int32) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		atomic.AddInt32(calls, 1)
+
+		clientID, clientSecret, ok := r.BasicAuth()
+
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// RFC 6749 2.3.1, the client credentials are form encoded before basic auth
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+
+		if clientID != "gateway" || clientSecret != "s3cret:&=" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != http.MethodPost || r.PostFormValue("token_type_hint") != "access_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		response, ok := responses[r.PostFormValue("token")]
+
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(response))
+	}))
+}
+
+func TestIntrospectionValidate(t *testing.T) {
+
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	var calls int32
+
+	server := introspectionServer(map[string]string{
+		"active":        `{"active": true, "sub": "u-1", "username": "alice", "scope": "read write", "groups": ["admins", "devs"], "exp": ` + exp + `}`,
+		"subject-only":  `{"active": true, "sub": "u-2", "groups": "ops devs"}`,
+		"inactive":      `{"active": false}`,
+		"expired":       `{"active": true, "sub": "u-3", "exp": ` + expired + `}`,
+		"malformed-exp": `{"active": true, "sub": "u-4", "exp": "soon"}`,
+	}, &calls)
+
+	defer server.Close()
+
+	introspection, err := NewIntrospection(server.URL, "gateway", "s3cret:&=")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token  string
+		claims jwt.MapClaims
+		err    string
+		outage bool
+		cached bool
+	}{
+		{
+			token:  "active",
+			claims: jwt.MapClaims{"uid": "u-1", "username": "alice", "scope": "read write", "groups": []interface{}{"admins", "devs"}},
+			cached: true,
+		},
+		{
+			token:  "subject-only",
+			claims: jwt.MapClaims{"uid": "u-2", "username": "u-2", "groups": []string{"ops", "devs"}},
+		},
+		{token: "inactive", err: "token is not active"},
+		{token: "expired", err: "token is expired"},
+		{token: "malformed-exp", err: "token introspection failed: json:", outage: true},
+		{token: "unknown", err: "token introspection failed: 500 Internal Server Error", outage: true},
+	}
+
+	for _, test := range tests {
+
+		atomic.StoreInt32(&calls, 0)
+
+		token, err := introspection.validate(test.token)
+
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q but got %v", test.token, test.err, err)
+			}
+			if isIntrospectionUnavailable(err) != test.outage {
+				t.Errorf("%s: expected unavailable %v but got %v", test.token, test.outage, !test.outage)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.token, err)
+			continue
+		}
+
+		claims := token.Claims.(jwt.MapClaims)
+
+		for key, expected := range test.claims {
+			if !reflect.DeepEqual(claims[key], expected) {
+				t.Errorf("%s: expected claim %s %#v but got %#v", test.token, key, expected, claims[key])
+			}
+		}
+
+		// only results with exp are cached
+		if _, err := introspection.validate(test.token); err != nil {
+			t.Errorf("%s: %v", test.token, err)
+		}
+
+		expectedCalls := int32(2)
+
+		if test.cached {
+			expectedCalls = 1
+		}
+
+		if calls := atomic.LoadInt32(&calls); calls != expectedCalls {
+			t.Errorf("%s: expected %d introspection requests but got %d", test.token, expectedCalls, calls)
+		}
+	}
+}
+
+func TestIntrospectionClientCredentials(t *testing.T) {
+
+	var calls int32
+
+	server := introspectionServer(map[string]string{"active": `{"active": true, "sub": "u-1"}`}, &calls)
+
+	defer server.Close()
+
+	introspection, err := NewIntrospection(server.URL, "gateway", "wrong")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := introspection.validate("active"); !isIntrospectionUnavailable(err) {
+		t.Errorf("expected the rejected client credentials to fail as unavailable but got %v", err)
+	}
+}
+
+func TestIntrospectionUnavailable(t *testing.T) {
+
+	var calls int32
+
+	server := introspectionServer(map[string]string{"inactive": `{"active": false}`}, &calls)
+
+	introspection, err := NewIntrospection(server.URL, "gateway", "s3cret:&=")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lockout, err := NewLockout(1, time.Minute, time.Minute, time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Auth{Rules: []Rule{{
+		Path:          "/",
+		TokenSources:  defaultTokenSources(),
+		Introspection: introspection,
+		Lockout:       lockout,
+	}}}
+
+	serve := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		status, _ := h.ServeHTTP(httptest.NewRecorder(), req)
+		return status
+	}
+
+	// an error status of the endpoint
+	if status := serve("unknown"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected %d for an endpoint error but got %d", http.StatusServiceUnavailable, status)
+	}
+
+	server.Close()
+
+	// a transport error
+	if status := serve("inactive"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected %d for an unreachable endpoint but got %d", http.StatusServiceUnavailable, status)
+	}
+
+	if len(lockout.records) != 0 {
+		t.Errorf("expected outages not to count as failures but got %d records", len(lockout.records))
+	}
+}
+
+func TestIntrospectionInactiveCountsAsFailure(t *testing.T) {
+
+	var calls int32
+
+	server := introspectionServer(map[string]string{"inactive": `{"active": false}`}, &calls)
+
+	defer server.Close()
+
+	introspection, err := NewIntrospection(server.URL, "gateway", "s3cret:&=")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lockout, err := NewLockout(1, time.Minute, time.Minute, time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Auth{Rules: []Rule{{Path: "/", TokenSources: defaultTokenSources(), Introspection: introspection, Lockout: lockout}}}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+	req.Header.Set("Authorization", "Bearer inactive")
+
+	if status, _ := h.ServeHTTP(httptest.NewRecorder(), req); status != http.StatusUnauthorized {
+		t.Errorf("expected %d but got %d", http.StatusUnauthorized, status)
+	}
+
+	if len(lockout.records) == 0 {
+		t.Errorf("expected the inactive token to count as a failure")
+	}
+}
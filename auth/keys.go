@@ -0,0 +1,332 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// VerificationKeyPollInterval how often the verification key sources are checked for rotation
+const VerificationKeyPollInterval = time.Minute
+
+// VerificationKeys are the HMAC secrets user tokens are verified with. A token naming a kid
+// is verified with that key only, other tokens with each key in order.
+type VerificationKeys struct {
+	sources []string
+	secrets *KeySecrets
+	lock    sync.RWMutex
+	keys    map[string][]verificationKey
+}
+
+type verificationKey struct {
+	id     string
+	secret []byte
+}
+
+// NewVerificationKeys loads the keys of each source and reloads them on change. A source is
+//
+//	a file, the key id is the file name
+//	a directory, e.g. a mounted Secret, with a key per file named after the file
+//	secret://<namespace>/<name> with a key per Secret key
+//	secret://<namespace>/<name>/<key> with a single key
+//
+// The sources are polled until stop is closed.
+func NewVerificationKeys(sources []string, secrets *KeySecrets, stop <-chan struct{}) (*VerificationKeys, error) {
+
+	keys := &VerificationKeys{sources: sources, secrets: secrets, keys: make(map[string][]verificationKey)}
+
+	for _, source := range sources {
+		if err := keys.reload(source); err != nil {
+			return nil, fmt.Errorf("verification keys %s: %v", source, err)
+		}
+	}
+
+	go wait.Until(func() {
+		for _, source := range sources {
+			if err := keys.reload(source); err != nil {
+				log.Printf("verification keys %s could not be reloaded: %v", source, err)
+			}
+		}
+	}, VerificationKeyPollInterval, stop)
+
+	return keys, nil
+}
+
+// staticVerificationKeys verify with a single secret without key id, e.g. JWT_SECRET
+func staticVerificationKeys(secret []byte) *VerificationKeys {
+	return &VerificationKeys{keys: map[string][]verificationKey{"": {{secret: secret}}}}
+}
+
+func (k *VerificationKeys) reload(source string) error {
+
+	loaded, err := readVerificationKeys(source, k.secrets)
+
+	if err != nil {
+		return err
+	}
+
+	if len(loaded) == 0 {
+		return fmt.Errorf("no keys found")
+	}
+
+	for _, key := range loaded {
+		if len(key.secret) == 0 {
+			return fmt.Errorf("key %s is empty", key.id)
+		}
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if sameVerificationKeys(k.keys[source], loaded) {
+		return nil
+	}
+
+	k.keys[source] = loaded
+
+	ids := make([]string, 0, len(loaded))
+
+	for _, key := range loaded {
+		ids = append(ids, key.id)
+	}
+
+	log.Printf("verification keys %s loaded: %s", source, strings.Join(ids, ", "))
+
+	return nil
+}
+
+func sameVerificationKeys(a []verificationKey, b []verificationKey) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].id != b[i].id || !bytes.Equal(a[i].secret, b[i].secret) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// candidates are the keys named by the kid of uToken, or every key in order without kid
+func (k *VerificationKeys) candidates(uToken string) ([]verificationKey, error) {
+
+	kid := ""
+
+	if token, _, err := new(jwt.Parser).ParseUnverified(uToken, jwt.MapClaims{}); err == nil {
+		kid, _ = token.Header["kid"].(string)
+	}
+
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	candidates := make([]verificationKey, 0)
+
+	sources := k.sources
+
+	if sources == nil {
+		sources = []string{""}
+	}
+
+	for _, source := range sources {
+		for _, key := range k.keys[source] {
+			if kid == "" || key.id == kid {
+				candidates = append(candidates, key)
+			}
+		}
+	}
+
+	if len(candidates) == 0 && kid != "" {
+		return nil, fmt.Errorf("unknown key id %s", kid)
+	}
+
+	return candidates, nil
+}
+
+func (k *VerificationKeys) validate(uToken string) (*jwt.Token, error) {
+
+	keys, err := k.candidates(uToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+
+		var token *jwt.Token
+
+		token, err = jwt.Parse(uToken, key.provide)
+
+		if err == nil {
+			return token, nil
+		}
+
+		// only a wrong signature is worth trying the next key
+		if validationErr, ok := err.(*jwt.ValidationError); !ok || validationErr.Errors&jwt.ValidationErrorSignatureInvalid == 0 {
+			return nil, err
+		}
+	}
+
+	if err == nil {
+		err = fmt.Errorf("no verification keys")
+	}
+
+	return nil, err
+}
+
+func (key verificationKey) provide(token *jwt.Token) (interface{}, error) {
+	if len(key.secret) == 0 {
+		return nil, fmt.Errorf("empty verification key")
+	}
+
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return key.secret, nil
+	} else {
+		return nil, fmt.Errorf("expect token signed with HMAC but got %v", token.Header["alg"])
+	}
+}
+
+func readVerificationKeys(source string, secrets *KeySecrets) ([]verificationKey, error) {
+
+	if strings.HasPrefix(source, secretSourcePrefix) {
+		return readSecretVerificationKeys(source, secrets)
+	}
+
+	info, err := os.Stat(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		data, err := ioutil.ReadFile(source)
+
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := newVerificationKey(filepath.Base(source), data)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return []verificationKey{key}, nil
+	}
+
+	files, err := ioutil.ReadDir(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]verificationKey, 0, len(files))
+
+	for _, file := range files {
+
+		// skips the ..data links of mounted Secrets and other hidden files
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(source, file.Name())
+
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := newVerificationKey(file.Name(), data)
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func readSecretVerificationKeys(source string, secrets *KeySecrets) ([]verificationKey, error) {
+
+	parts := strings.Split(strings.TrimPrefix(source, secretSourcePrefix), "/")
+
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("expect %s<namespace>/<name>[/<key>] but got %s", secretSourcePrefix, source)
+	}
+
+	secret, err := secrets.get(parts[0], parts[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parts) == 3 {
+		data, ok := secret.Data[parts[2]]
+
+		if !ok {
+			return nil, fmt.Errorf("secret %s/%s has no key %s", parts[0], parts[1], parts[2])
+		}
+
+		key, err := newVerificationKey(parts[2], data)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return []verificationKey{key}, nil
+	}
+
+	ids := make([]string, 0, len(secret.Data))
+
+	for id := range secret.Data {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	keys := make([]verificationKey, 0, len(ids))
+
+	for _, id := range ids {
+		key, err := newVerificationKey(id, secret.Data[id])
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// newVerificationKey drops the trailing newline editors and echo leave in key files. Empty keys
+// are rejected, anyone could sign a token with an empty HMAC key.
+func newVerificationKey(id string, data []byte) (verificationKey, error) {
+
+	secret := bytes.TrimRight(data, "\r\n")
+
+	if len(secret) == 0 {
+		return verificationKey{}, fmt.Errorf("key %s is empty", id)
+	}
+
+	return verificationKey{id: id, secret: secret}, nil
+}
@@ -0,0 +1,324 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	admission "kubesphere.io/caddy-plugin/addmission"
+)
+
+var (
+	authFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "auth",
+		Name:      "failures_total",
+		Help:      "Number of requests presenting an invalid token.",
+	})
+	lockoutRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "auth",
+		Name:      "lockout_rejections_total",
+		Help:      "Number of requests rejected because the client or token is banned.",
+	})
+	lockoutBans = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "auth",
+		Name:      "lockout_bans_total",
+		Help:      "Number of temporary bans issued after repeated authentication failures.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(authFailures, lockoutRejections, lockoutBans)
+}
+
+// shared lockouts by name, site blocks naming the same lockout count failures together. The
+// generation is advanced on startup, so lockouts of an older generation were registered by the
+// configuration running before a reload.
+var sharedLockouts = struct {
+	sync.Mutex
+	lockouts   map[string]*sharedLockout
+	generation int
+}{lockouts: make(map[string]*sharedLockout)}
+
+type sharedLockout struct {
+	lockout    *Lockout
+	generation int
+	sites      int
+}
+
+// lockout records are swept at most once per lockoutSweepInterval
+const lockoutSweepInterval = time.Minute
+
+// Lockout bans a client IP or a presented token for Ban after Threshold authentication
+// failures within Window, every further ban doubles the duration up to MaxBan
+type Lockout struct {
+	Threshold int
+	Window    time.Duration
+	Ban       time.Duration
+	MaxBan    time.Duration
+	// ClientIPHeader, e.g. X-Forwarded-For, identifies clients behind a proxy
+	ClientIPHeader string
+
+	lock      sync.Mutex
+	records   map[string]*failureRecord
+	lastSweep time.Time
+}
+
+type failureRecord struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	Bans        int       `json:"bans"`
+	BannedUntil time.Time `json:"bannedUntil,omitempty"`
+	windowStart time.Time
+	lastFailure time.Time
+}
+
+func NewLockout(threshold int, window, ban, maxBan time.Duration) (*Lockout, error) {
+
+	if threshold <= 0 || window <= 0 || ban <= 0 {
+		return nil, fmt.Errorf("lockout threshold, window and ban must be positive")
+	}
+
+	if maxBan < ban {
+		maxBan = ban
+	}
+
+	return &Lockout{Threshold: threshold, Window: window, Ban: ban, MaxBan: maxBan, records: make(map[string]*failureRecord)}, nil
+}
+
+// SharedLockout returns the lockout registered under name when it is defined like l, so its
+// records survive a reload, and registers l otherwise. Defining the lockout differently than a
+// site of the same configuration is an error, a definition of the previous one is replaced.
+func SharedLockout(name string, l *Lockout) (*Lockout, error) {
+
+	sharedLockouts.Lock()
+	defer sharedLockouts.Unlock()
+
+	shared, ok := sharedLockouts.lockouts[name]
+
+	switch {
+	case ok && shared.lockout.sameDefinition(l):
+		shared.generation = sharedLockouts.generation
+		shared.sites++
+		return shared.lockout, nil
+	case ok && shared.generation == sharedLockouts.generation:
+		return nil, fmt.Errorf("lockout %s is defined differently by another site", name)
+	}
+
+	sharedLockouts.lockouts[name] = &sharedLockout{lockout: l, generation: sharedLockouts.generation, sites: 1}
+
+	return l, nil
+}
+
+// releaseSharedLockouts unregisters the shared lockouts of rules when the last site using them shuts down
+func releaseSharedLockouts(rules []Rule) {
+
+	sharedLockouts.Lock()
+	defer sharedLockouts.Unlock()
+
+	for _, rule := range rules {
+
+		shared, ok := sharedLockouts.lockouts[rule.LockoutName]
+
+		if !ok || shared.lockout != rule.Lockout {
+			continue
+		}
+
+		if shared.sites--; shared.sites <= 0 {
+			delete(sharedLockouts.lockouts, rule.LockoutName)
+		}
+	}
+}
+
+// startSharedLockouts marks the lockouts registered so far as those of the running configuration
+func startSharedLockouts() {
+	sharedLockouts.Lock()
+	sharedLockouts.generation++
+	sharedLockouts.Unlock()
+}
+
+func (l *Lockout) sameDefinition(other *Lockout) bool {
+	return l.Threshold == other.Threshold && l.Window == other.Window && l.Ban == other.Ban &&
+		l.MaxBan == other.MaxBan && l.ClientIPHeader == other.ClientIPHeader
+}
+
+// banned reports whether the client or the presented token is banned and for how long
+func (l *Lockout) banned(req *http.Request, uToken string) (bool, time.Duration) {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	var retryAfter time.Duration
+
+	for _, key := range l.keys(req, uToken) {
+		if record, ok := l.records[key]; ok && record.BannedUntil.After(now) {
+			if d := record.BannedUntil.Sub(now); d > retryAfter {
+				retryAfter = d
+			}
+		}
+	}
+
+	if retryAfter > 0 {
+		lockoutRejections.Inc()
+		return true, retryAfter
+	}
+
+	return false, 0
+}
+
+func (l *Lockout) failed(req *http.Request, uToken string) {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	authFailures.Inc()
+
+	for _, key := range l.keys(req, uToken) {
+
+		record, ok := l.records[key]
+
+		if !ok {
+			record = &failureRecord{Key: key}
+			l.records[key] = record
+		}
+
+		// forget earlier bans once the subject behaved for the longest ban
+		if now.Sub(record.lastFailure) > l.MaxBan {
+			record.Bans = 0
+		}
+
+		if now.Sub(record.windowStart) > l.Window {
+			record.windowStart = now
+			record.Failures = 0
+		}
+
+		record.Failures++
+		record.lastFailure = now
+
+		if record.Failures >= l.Threshold {
+			ban := l.Ban << uint(record.Bans)
+			if ban > l.MaxBan || ban <= 0 {
+				ban = l.MaxBan
+			}
+			record.Bans++
+			record.Failures = 0
+			record.BannedUntil = now.Add(ban)
+			lockoutBans.Inc()
+		}
+	}
+}
+
+// succeeded clears the failure count, bans stay until they expire
+func (l *Lockout) succeeded(req *http.Request, uToken string) {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, key := range l.keys(req, uToken) {
+		if record, ok := l.records[key]; ok {
+			record.Failures = 0
+		}
+	}
+}
+
+func (l *Lockout) sweep(now time.Time) {
+
+	if now.Sub(l.lastSweep) < lockoutSweepInterval {
+		return
+	}
+
+	for key, record := range l.records {
+		if record.BannedUntil.Before(now) && now.Sub(record.lastFailure) > l.MaxBan && now.Sub(record.lastFailure) > l.Window {
+			delete(l.records, key)
+		}
+	}
+
+	l.lastSweep = now
+}
+
+// serveAdmin lists current bans on GET and clears them on DELETE, all of them or the one given by ?key=
+func (l *Lockout) serveAdmin(w http.ResponseWriter, req *http.Request) (int, error) {
+
+	if err := authorizeAdmin(req); err != nil {
+		return handleForbidden(w, req, err.Error()), nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+
+	switch req.Method {
+	case http.MethodGet:
+		bans := make([]failureRecord, 0)
+		for _, record := range l.records {
+			if record.BannedUntil.After(now) {
+				bans = append(bans, *record)
+			}
+		}
+		sort.Slice(bans, func(i, j int) bool { return bans[i].Key < bans[j].Key })
+		return admission.WriteJSON(w, http.StatusOK, bans)
+	case http.MethodDelete:
+		key := req.URL.Query().Get("key")
+		for k := range l.records {
+			if key == "" || key == k {
+				delete(l.records, k)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return http.StatusNoContent, nil
+	default:
+		return http.StatusMethodNotAllowed, nil
+	}
+}
+
+// keys identify the client IP and the presented token. Failures are not counted against the
+// username a token claims, its signature is not verified yet and anyone could lock out any user.
+func (l *Lockout) keys(req *http.Request, uToken string) []string {
+
+	keys := make([]string, 0, 2)
+
+	keys = append(keys, "ip:"+l.clientIP(req))
+
+	if uToken == "" {
+		return keys
+	}
+
+	sum := sha256.Sum256([]byte(uToken))
+
+	return append(keys, "token:"+hex.EncodeToString(sum[:8]))
+}
+
+// clientIP is the last address of ClientIPHeader, as appended by the trusted proxy in front of
+// the gateway, or the remote address without it
+func (l *Lockout) clientIP(req *http.Request) string {
+
+	if l.ClientIPHeader != "" {
+		if value := req.Header.Get(l.ClientIPHeader); value != "" {
+			addresses := strings.Split(value, ",")
+			if ip := strings.TrimSpace(addresses[len(addresses)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+
+	type attempt struct {
+		remoteAddr string
+		forwarded  string
+		token      string
+		failed     bool
+	}
+
+	tests := []struct {
+		name           string
+		threshold      int
+		clientIPHeader string
+		attempts       []attempt
+		probe          attempt
+		banned         bool
+		ban            time.Duration
+	}{
+		{
+			name:      "below the threshold",
+			threshold: 3,
+			attempts:  []attempt{{remoteAddr: "10.0.0.1:1", failed: true}, {remoteAddr: "10.0.0.1:2", failed: true}},
+			probe:     attempt{remoteAddr: "10.0.0.1:3"},
+		},
+		{
+			name:      "threshold bans the client",
+			threshold: 2,
+			attempts:  []attempt{{remoteAddr: "10.0.0.1:1", failed: true}, {remoteAddr: "10.0.0.1:2", failed: true}},
+			probe:     attempt{remoteAddr: "10.0.0.1:3"},
+			banned:    true,
+			ban:       time.Minute,
+		},
+		{
+			name:      "other clients are not banned",
+			threshold: 2,
+			attempts:  []attempt{{remoteAddr: "10.0.0.1:1", failed: true}, {remoteAddr: "10.0.0.1:2", failed: true}},
+			probe:     attempt{remoteAddr: "10.0.0.2:1"},
+		},
+		{
+			name:      "the token is banned from every client",
+			threshold: 2,
+			attempts:  []attempt{{remoteAddr: "10.0.0.1:1", token: "stolen", failed: true}, {remoteAddr: "10.0.0.2:1", token: "stolen", failed: true}},
+			probe:     attempt{remoteAddr: "10.0.0.3:1", token: "stolen"},
+			banned:    true,
+			ban:       time.Minute,
+		},
+		{
+			name:      "success clears the failures",
+			threshold: 2,
+			attempts:  []attempt{{remoteAddr: "10.0.0.1:1", failed: true}, {remoteAddr: "10.0.0.1:2"}, {remoteAddr: "10.0.0.1:3", failed: true}},
+			probe:     attempt{remoteAddr: "10.0.0.1:4"},
+		},
+		{
+			name:      "repeated bans double",
+			threshold: 1,
+			attempts:  []attempt{{remoteAddr: "10.0.0.1:1", failed: true}, {remoteAddr: "10.0.0.1:2", failed: true}},
+			probe:     attempt{remoteAddr: "10.0.0.1:3"},
+			banned:    true,
+			ban:       2 * time.Minute,
+		},
+		{
+			name:      "bans are capped",
+			threshold: 1,
+			attempts:  []attempt{{remoteAddr: "10.0.0.1:1", failed: true}, {remoteAddr: "10.0.0.1:2", failed: true}, {remoteAddr: "10.0.0.1:3", failed: true}, {remoteAddr: "10.0.0.1:4", failed: true}},
+			probe:     attempt{remoteAddr: "10.0.0.1:5"},
+			banned:    true,
+			ban:       5 * time.Minute,
+		},
+		{
+			name:           "client behind the proxy",
+			threshold:      1,
+			clientIPHeader: "X-Forwarded-For",
+			attempts:       []attempt{{remoteAddr: "10.0.0.254:1", forwarded: "spoofed, 192.168.0.1", failed: true}},
+			probe:          attempt{remoteAddr: "10.0.0.254:2", forwarded: "192.168.0.1"},
+			banned:         true,
+			ban:            time.Minute,
+		},
+		{
+			name:           "other clients behind the proxy",
+			threshold:      1,
+			clientIPHeader: "X-Forwarded-For",
+			attempts:       []attempt{{remoteAddr: "10.0.0.254:1", forwarded: "192.168.0.1", failed: true}},
+			probe:          attempt{remoteAddr: "10.0.0.254:2", forwarded: "192.168.0.1, 192.168.0.2"},
+		},
+	}
+
+	request := func(a attempt) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+		req.RemoteAddr = a.remoteAddr
+		if a.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", a.forwarded)
+		}
+		return req
+	}
+
+	for _, test := range tests {
+
+		lockout, err := NewLockout(test.threshold, time.Hour, time.Minute, 5*time.Minute)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lockout.ClientIPHeader = test.clientIPHeader
+
+		for _, a := range test.attempts {
+			if a.failed {
+				lockout.failed(request(a), a.token)
+			} else {
+				lockout.succeeded(request(a), a.token)
+			}
+		}
+
+		banned, retryAfter := lockout.banned(request(test.probe), test.probe.token)
+
+		if banned != test.banned {
+			t.Errorf("%s: expected banned %v but got %v", test.name, test.banned, banned)
+			continue
+		}
+
+		if banned && (retryAfter > test.ban || retryAfter < test.ban-time.Second) {
+			t.Errorf("%s: expected a ban of %s but got %s", test.name, test.ban, retryAfter)
+		}
+	}
+}
+
+func TestSharedLockout(t *testing.T) {
+
+	define := func(threshold int, clientIPHeader string) *Lockout {
+		lockout, err := NewLockout(threshold, time.Hour, time.Minute, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lockout.ClientIPHeader = clientIPHeader
+		return lockout
+	}
+
+	first, err := SharedLockout("test-shared", define(3, "X-Forwarded-For"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another site of the same configuration
+	if second, err := SharedLockout("test-shared", define(3, "X-Forwarded-For")); err != nil || second != first {
+		t.Errorf("expected the same definition to share the lockout but got %v", err)
+	}
+
+	if _, err := SharedLockout("test-shared", define(3, "X-Real-Ip")); err == nil {
+		t.Errorf("expected a different client IP header to be rejected")
+	}
+
+	if _, err := SharedLockout("test-shared", define(5, "X-Forwarded-For")); err == nil {
+		t.Errorf("expected a different threshold to be rejected")
+	}
+
+	startSharedLockouts()
+
+	// a reload keeps the records of an unchanged definition
+	if kept, err := SharedLockout("test-shared", define(3, "X-Forwarded-For")); err != nil || kept != first {
+		t.Errorf("expected the reload to keep the lockout but got %v", err)
+	}
+
+	startSharedLockouts()
+
+	reloaded, err := SharedLockout("test-shared", define(5, "X-Forwarded-For"))
+
+	if err != nil || reloaded == first || reloaded.Threshold != 5 {
+		t.Fatalf("expected the reload to replace the lockout but got %v", err)
+	}
+
+	// the sites of the previous configuration shut down after the reload
+	releaseSharedLockouts([]Rule{{LockoutName: "test-shared", Lockout: first}, {LockoutName: "test-shared", Lockout: first}})
+
+	if shared, ok := sharedLockouts.lockouts["test-shared"]; !ok || shared.lockout != reloaded {
+		t.Errorf("expected the shutdown of the previous sites to keep the reloaded lockout")
+	}
+
+	releaseSharedLockouts([]Rule{{LockoutName: "test-shared", Lockout: reloaded}})
+
+	if _, ok := sharedLockouts.lockouts["test-shared"]; ok {
+		t.Errorf("expected the lockout to be released with its last site")
+	}
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+const (
+	RateLimitByUser             = "user"
+	RateLimitByGroup            = "group"
+	RateLimitByUserVerbResource = "user_verb_resource"
+)
+
+// idle limiters are dropped after limiterIdleTimeout, swept at most once per limiterSweepInterval
+const limiterIdleTimeout = time.Minute * 10
+const limiterSweepInterval = time.Minute
+
+// RateLimit is a token bucket applied per authenticated identity
+type RateLimit struct {
+	Key   string
+	Rate  rate.Limit
+	Burst int
+	store *limiterStore
+}
+
+type limiterStore struct {
+	sync.Mutex
+	limiters  map[string]*limiterEntry
+	lastSweep time.Time
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func NewRateLimit(key string, limit rate.Limit, burst int) (*RateLimit, error) {
+
+	switch key {
+	case RateLimitByUser, RateLimitByGroup, RateLimitByUserVerbResource:
+	default:
+		return nil, fmt.Errorf("unknown rate limit key %s", key)
+	}
+
+	if limit <= 0 || burst <= 0 {
+		return nil, fmt.Errorf("rate limit and burst must be positive")
+	}
+
+	return &RateLimit{Key: key, Rate: limit, Burst: burst, store: &limiterStore{limiters: make(map[string]*limiterEntry)}}, nil
+}
+
+// reserve takes a token from every bucket of the request, on rejection
+// nothing is consumed and the time until a retry can succeed is returned
+func (l *RateLimit) reserve(req *http.Request) (bool, time.Duration) {
+
+	now := time.Now()
+	reservations := make([]*rate.Reservation, 0)
+	var delay time.Duration
+
+	for _, key := range l.keys(req) {
+		reservation := l.store.get(key, l.Rate, l.Burst, now).ReserveN(now, 1)
+		reservations = append(reservations, reservation)
+
+		if d := reservation.DelayFrom(now); d > delay {
+			delay = d
+		}
+	}
+
+	if delay == 0 {
+		return true, 0
+	}
+
+	for _, reservation := range reservations {
+		reservation.CancelAt(now)
+	}
+
+	return false, delay
+}
+
+func (l *RateLimit) keys(req *http.Request) []string {
+
+	usr, ok := request.UserFrom(req.Context())
+
+	if !ok {
+		return nil
+	}
+
+	switch l.Key {
+	case RateLimitByGroup:
+		keys := make([]string, 0)
+		for _, group := range usr.GetGroups() {
+			keys = append(keys, "group:"+group)
+		}
+		return keys
+	case RateLimitByUserVerbResource:
+		info, ok := request.RequestInfoFrom(req.Context())
+		if !ok {
+			return []string{"user:" + usr.GetName()}
+		}
+		if !info.IsResourceRequest {
+			return []string{fmt.Sprintf("user:%s:%s:%s", usr.GetName(), info.Verb, info.Path)}
+		}
+		return []string{fmt.Sprintf("user:%s:%s:%s/%s", usr.GetName(), info.Verb, info.APIGroup, info.Resource)}
+	default:
+		return []string{"user:" + usr.GetName()}
+	}
+}
+
+func (s *limiterStore) get(key string, limit rate.Limit, burst int, now time.Time) *rate.Limiter {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if now.Sub(s.lastSweep) > limiterSweepInterval {
+		for k, entry := range s.limiters {
+			if now.Sub(entry.lastSeen) > limiterIdleTimeout {
+				delete(s.limiters, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	entry, ok := s.limiters[key]
+
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(limit, burst)}
+		s.limiters[key] = entry
+	}
+
+	entry.lastSeen = now
+
+	return entry.limiter
+}
+
+func handleTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) int {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	return http.StatusTooManyRequests
+}
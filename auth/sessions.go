@@ -0,0 +1,360 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apiserver/pkg/endpoints/request"
+	admission "kubesphere.io/caddy-plugin/addmission"
+)
+
+const (
+	SessionStoreMemory = "memory"
+	// SessionStoreFilePrefix selects a store persisted to a JSON file, file:<path>
+	SessionStoreFilePrefix = "file:"
+)
+
+const defaultSessionCookie = "ksession"
+
+// last seen times are persisted to a file store at most once per sessionTouchInterval
+const sessionTouchInterval = time.Minute
+
+// Session maps an opaque browser cookie to the token of the user who logged in
+type Session struct {
+	ID       string    `json:"id"`
+	Token    string    `json:"token"`
+	Username string    `json:"username"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"lastSeen"`
+	Expires  time.Time `json:"expires"`
+}
+
+// SessionStore keeps sessions by ID
+type SessionStore interface {
+	Get(id string) (*Session, bool)
+	Put(session *Session) error
+	Delete(id string) error
+	List() []*Session
+}
+
+// Sessions trade a token for an opaque cookie on LoginPath, expire it after Idle without
+// requests or after Lifetime and revoke it on LogoutPath
+type Sessions struct {
+	Store      SessionStore
+	Idle       time.Duration
+	Lifetime   time.Duration
+	CookieName string
+	LoginPath  string
+	LogoutPath string
+	AdminPath  string
+}
+
+func NewSessions(store string, idle, lifetime time.Duration) (*Sessions, error) {
+
+	if idle <= 0 || lifetime <= 0 {
+		return nil, fmt.Errorf("session idle timeout and lifetime must be positive")
+	}
+
+	sessions := &Sessions{Idle: idle, Lifetime: lifetime, CookieName: defaultSessionCookie}
+
+	switch {
+	case store == SessionStoreMemory:
+		sessions.Store = newMemorySessionStore()
+	case strings.HasPrefix(store, SessionStoreFilePrefix):
+		fileStore, err := newFileSessionStore(strings.TrimPrefix(store, SessionStoreFilePrefix))
+		if err != nil {
+			return nil, err
+		}
+		sessions.Store = fileStore
+	default:
+		return nil, fmt.Errorf("unknown session store %s", store)
+	}
+
+	return sessions, nil
+}
+
+// session returns the live session named by the session cookie and refreshes its idle
+// expiry, the cookie is removed so it does not reach the upstream
+func (s *Sessions) session(req *http.Request) (*Session, bool) {
+
+	cookie, err := req.Cookie(s.CookieName)
+
+	if err != nil {
+		return nil, false
+	}
+
+	removeCookie(req, s.CookieName)
+
+	session, ok := s.Store.Get(cookie.Value)
+
+	if !ok {
+		return nil, false
+	}
+
+	now := time.Now()
+
+	if now.After(session.Expires) || now.Sub(session.LastSeen) > s.Idle {
+		s.Store.Delete(session.ID)
+		return nil, false
+	}
+
+	if now.Sub(session.LastSeen) > sessionTouchInterval {
+		touched := *session
+		touched.LastSeen = now
+		s.Store.Put(&touched)
+	}
+
+	return session, true
+}
+
+func (s *Sessions) login(w http.ResponseWriter, req *http.Request, uToken string) (int, error) {
+
+	if req.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	usr, _ := request.UserFrom(req.Context())
+	now := time.Now()
+
+	for _, session := range s.Store.List() {
+		if now.After(session.Expires) || now.Sub(session.LastSeen) > s.Idle {
+			s.Store.Delete(session.ID)
+		}
+	}
+
+	id := make([]byte, 32)
+
+	if _, err := rand.Read(id); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	session := &Session{
+		ID:       base64.RawURLEncoding.EncodeToString(id),
+		Token:    uToken,
+		Username: usr.GetName(),
+		Created:  now,
+		LastSeen: now,
+		Expires:  now.Add(s.Lifetime),
+	}
+
+	if err := s.Store.Put(session); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.CookieName,
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.Expires,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+	})
+
+	return admission.WriteJSON(w, http.StatusOK, sessionView(session))
+}
+
+// logout revokes sessionID, the session the request was authenticated with if any, as the
+// cookie has already been removed from the request
+func (s *Sessions) logout(w http.ResponseWriter, req *http.Request, sessionID string) (int, error) {
+
+	if sessionID != "" {
+		s.Store.Delete(sessionID)
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: s.CookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: req.TLS != nil})
+	w.WriteHeader(http.StatusNoContent)
+
+	return http.StatusNoContent, nil
+}
+
+// serveAdmin lists sessions on GET, optionally for ?user=, and revokes them on DELETE
+// by ?id= as listed or by ?user=
+func (s *Sessions) serveAdmin(w http.ResponseWriter, req *http.Request) (int, error) {
+
+	if err := authorizeAdmin(req); err != nil {
+		return handleForbidden(w, req, err.Error()), nil
+	}
+
+	username := req.URL.Query().Get("user")
+	id := req.URL.Query().Get("id")
+
+	switch req.Method {
+	case http.MethodGet:
+		views := make([]map[string]interface{}, 0)
+		for _, session := range s.Store.List() {
+			if username == "" || session.Username == username {
+				views = append(views, sessionView(session))
+			}
+		}
+		return admission.WriteJSON(w, http.StatusOK, views)
+	case http.MethodDelete:
+		if username == "" && id == "" {
+			return http.StatusBadRequest, fmt.Errorf("user or id required")
+		}
+		for _, session := range s.Store.List() {
+			if (username != "" && session.Username == username) || (id != "" && sessionHash(session.ID) == id) {
+				s.Store.Delete(session.ID)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return http.StatusNoContent, nil
+	default:
+		return http.StatusMethodNotAllowed, nil
+	}
+}
+
+// sessionView hides the session ID and token, sessions are referred to by a hash of the ID
+func sessionView(session *Session) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       sessionHash(session.ID),
+		"username": session.Username,
+		"created":  session.Created,
+		"lastSeen": session.LastSeen,
+		"expires":  session.Expires,
+	}
+}
+
+func sessionHash(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+func removeCookie(req *http.Request, name string) {
+
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			req.AddCookie(cookie)
+		}
+	}
+}
+
+type memorySessionStore struct {
+	lock     sync.RWMutex
+	sessions map[string]*Session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]*Session)}
+}
+
+func (m *memorySessionStore) Get(id string) (*Session, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	session, ok := m.sessions[id]
+	return session, ok
+}
+
+func (m *memorySessionStore) Put(session *Session) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sessions[session.ID] = session
+	return nil
+}
+
+func (m *memorySessionStore) Delete(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memorySessionStore) List() []*Session {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Created.Before(sessions[j].Created) })
+	return sessions
+}
+
+// fileSessionStore is a memory store written through to a JSON file, so sessions survive restarts
+type fileSessionStore struct {
+	*memorySessionStore
+	path  string
+	write sync.Mutex
+}
+
+func newFileSessionStore(path string) (*fileSessionStore, error) {
+
+	store := &fileSessionStore{memorySessionStore: newMemorySessionStore(), path: path}
+
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*Session, 0)
+
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, fmt.Errorf("session file %s: %v", path, err)
+	}
+
+	for _, session := range sessions {
+		store.sessions[session.ID] = session
+	}
+
+	return store, nil
+}
+
+func (f *fileSessionStore) Put(session *Session) error {
+	f.memorySessionStore.Put(session)
+	return f.persist()
+}
+
+func (f *fileSessionStore) Delete(id string) error {
+	f.memorySessionStore.Delete(id)
+	return f.persist()
+}
+
+func (f *fileSessionStore) persist() error {
+
+	f.write.Lock()
+	defer f.write.Unlock()
+
+	data, err := json.Marshal(f.List())
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path))
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestSessionLogout(t *testing.T) {
+
+	secret := []byte("secret")
+
+	uToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": "alice",
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	}).SignedString(secret)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := NewSessions(SessionStoreMemory, time.Hour, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions.LoginPath = "/login"
+	sessions.LogoutPath = "/logout"
+
+	h := &Auth{Rules: []Rule{{
+		Path:             "/",
+		TokenSources:     defaultTokenSources(),
+		VerificationKeys: staticVerificationKeys(secret),
+		Sessions:         sessions,
+	}}}
+
+	login := httptest.NewRequest(http.MethodPost, "/login", nil)
+	login.Header.Set("Authorization", "Bearer "+uToken)
+	recorder := httptest.NewRecorder()
+
+	if status, err := h.ServeHTTP(recorder, login); status != http.StatusOK || err != nil {
+		t.Fatalf("expected %d on login but got %d %v", http.StatusOK, status, err)
+	}
+
+	cookies := recorder.Result().Cookies()
+
+	if len(cookies) != 1 || cookies[0].Name != sessions.CookieName {
+		t.Fatalf("expected a session cookie but got %v", cookies)
+	}
+
+	serve := func(path string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.AddCookie(&http.Cookie{Name: cookies[0].Name, Value: cookies[0].Value})
+		status, _ := h.ServeHTTP(httptest.NewRecorder(), req)
+		return status
+	}
+
+	if status := serve("/logout"); status != http.StatusNoContent {
+		t.Fatalf("expected %d on logout but got %d", http.StatusNoContent, status)
+	}
+
+	if _, ok := sessions.Store.Get(cookies[0].Value); ok {
+		t.Errorf("expected the session to be deleted on logout")
+	}
+
+	if status := serve("/logout"); status != http.StatusUnauthorized {
+		t.Errorf("expected %d when reusing the cookie but got %d", http.StatusUnauthorized, status)
+	}
+}
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"gopkg.in/square/go-jose.v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	admission "kubesphere.io/caddy-plugin/addmission"
+	"kubesphere.io/caddy-plugin/addmission/informer"
+)
+
+// secretSourcePrefix selects a key stored in a Kubernetes Secret, secret://<namespace>/<name>/<key>
+const secretSourcePrefix = "secret://"
+
+// SigningKeyPollInterval how often the signing key source is checked for rotation
+const SigningKeyPollInterval = time.Minute
+
+// retired keys stay published so tokens signed before a rotation can still be verified
+const maxPublishedKeys = 3
+
+// SigningKeys signs downstream tokens with the current gateway key and publishes
+// the public keys as a JSON Web Key Set
+type SigningKeys struct {
+	source  string
+	secrets *KeySecrets
+	lock    sync.RWMutex
+	raw     []byte
+	keys    []*signingKey
+}
+
+type signingKey struct {
+	method  jwt.SigningMethod
+	private crypto.Signer
+	public  jose.JSONWebKey
+}
+
+// KeySecrets reads the Secrets of key and credential sources with a single clientset, created on first use
+type KeySecrets struct {
+	Client    informer.ClientConfig
+	lock      sync.Mutex
+	clientset kubernetes.Interface
+}
+
+// NewKeySecrets reads Secrets from the cluster of client
+func NewKeySecrets(client informer.ClientConfig) *KeySecrets {
+	return &KeySecrets{Client: client}
+}
+
+// configure sets the cluster of the Secrets, it fails once a Secret has been read
+func (s *KeySecrets) configure(client informer.ClientConfig) bool {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.clientset != nil {
+		return false
+	}
+
+	s.Client = client
+
+	return true
+}
+
+func (s *KeySecrets) get(namespace string, name string) (*corev1.Secret, error) {
+
+	s.lock.Lock()
+
+	if s.clientset == nil {
+		clientset, err := informer.NewClientset(s.Client)
+
+		if err != nil {
+			s.lock.Unlock()
+			return nil, err
+		}
+
+		s.clientset = clientset
+	}
+
+	clientset := s.clientset
+	s.lock.Unlock()
+
+	return clientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+}
+
+// NewSigningKeys loads a PEM encoded RSA or ECDSA private key from a file or a Secret and
+// reloads it on change until stop is closed
+func NewSigningKeys(source string, secrets *KeySecrets, stop <-chan struct{}) (*SigningKeys, error) {
+
+	keys := &SigningKeys{source: source, secrets: secrets}
+
+	if err := keys.reload(); err != nil {
+		return nil, err
+	}
+
+	go wait.Until(func() {
+		if err := keys.reload(); err != nil {
+			log.Printf("signing key %s could not be reloaded: %v", source, err)
+		}
+	}, SigningKeyPollInterval, stop)
+
+	return keys, nil
+}
+
+func (k *SigningKeys) reload() error {
+
+	raw, err := readKeySource(k.source, k.secrets)
+
+	if err != nil {
+		return err
+	}
+
+	k.lock.RLock()
+	unchanged := bytes.Equal(raw, k.raw)
+	k.lock.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	key, err := parseSigningKey(raw)
+
+	if err != nil {
+		return err
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.raw = raw
+	k.keys = append([]*signingKey{key}, k.keys...)
+
+	if len(k.keys) > maxPublishedKeys {
+		k.keys = k.keys[:maxPublishedKeys]
+	}
+
+	log.Printf("signing key %s loaded with kid %s", k.source, key.public.KeyID)
+
+	return nil
+}
+
+func (k *SigningKeys) sign(claims jwt.MapClaims) (string, error) {
+
+	k.lock.RLock()
+	key := k.keys[0]
+	k.lock.RUnlock()
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.public.KeyID
+
+	return token.SignedString(key.private)
+}
+
+func (k *SigningKeys) serveJWKS(w http.ResponseWriter) (int, error) {
+
+	k.lock.RLock()
+	set := jose.JSONWebKeySet{Keys: make([]jose.JSONWebKey, 0, len(k.keys))}
+	for _, key := range k.keys {
+		set.Keys = append(set.Keys, key.public)
+	}
+	k.lock.RUnlock()
+
+	w.Header().Set("Cache-Control", "public, max-age=60")
+
+	return admission.WriteJSON(w, http.StatusOK, set)
+}
+
+func readKeySource(source string, secrets *KeySecrets) ([]byte, error) {
+
+	if !strings.HasPrefix(source, secretSourcePrefix) {
+		return ioutil.ReadFile(source)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(source, secretSourcePrefix), "/")
+
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("expect %s<namespace>/<name>/<key> but got %s", secretSourcePrefix, source)
+	}
+
+	secret, err := secrets.get(parts[0], parts[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := secret.Data[parts[2]]
+
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no key %s", parts[0], parts[1], parts[2])
+	}
+
+	return data, nil
+}
+
+func parseSigningKey(raw []byte) (*signingKey, error) {
+
+	key := &signingKey{}
+
+	if rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM(raw); err == nil {
+		key.method = jwt.SigningMethodRS256
+		key.private = rsaKey
+	} else if ecKey, err := jwt.ParseECPrivateKeyFromPEM(raw); err == nil {
+		switch ecKey.Curve.Params().BitSize {
+		case 256:
+			key.method = jwt.SigningMethodES256
+		case 384:
+			key.method = jwt.SigningMethodES384
+		case 521:
+			key.method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", ecKey.Curve.Params().Name)
+		}
+		key.private = ecKey
+	} else {
+		return nil, fmt.Errorf("expect a PEM encoded RSA or ECDSA private key")
+	}
+
+	key.public = jose.JSONWebKey{Key: key.private.Public(), Algorithm: key.method.Alg(), Use: "sig"}
+
+	thumbprint, err := key.public.Thumbprint(crypto.SHA256)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key.public.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	return key, nil
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	TokenFromHeader    = "header"
+	TokenFromCookie    = "cookie"
+	TokenFromQuery     = "query"
+	TokenFromWebSocket = "websocket"
+	// TokenFromSession is the token of a server side session named by the session cookie
+	TokenFromSession = "session"
+)
+
+// websocketBearerPrefix marks the subprotocol carrying a base64url encoded bearer token,
+// as accepted by kube-apiserver for browser WebSocket clients
+const websocketBearerPrefix = "base64url.bearer.authorization.k8s.io."
+
+const webSocketProtocolHeader = "Sec-Websocket-Protocol"
+
+// TokenSource is a place a token is looked up, Name is the header, cookie or query parameter name
+type TokenSource struct {
+	Kind string
+	Name string
+}
+
+// defaultTokenSources are tried in order unless a rule configures token_sources
+func defaultTokenSources() []TokenSource {
+	return []TokenSource{
+		{Kind: TokenFromHeader, Name: "Authorization"},
+		{Kind: TokenFromCookie, Name: "token"},
+		{Kind: TokenFromQuery, Name: "token"},
+	}
+}
+
+// ParseTokenSource parses kind[:name], header, cookie and query default to Authorization, token and token
+func ParseTokenSource(arg string) (TokenSource, error) {
+
+	parts := strings.SplitN(arg, ":", 2)
+	source := TokenSource{Kind: parts[0]}
+
+	if len(parts) == 2 {
+		source.Name = parts[1]
+	}
+
+	switch source.Kind {
+	case TokenFromHeader:
+		if source.Name == "" {
+			source.Name = "Authorization"
+		}
+		source.Name = http.CanonicalHeaderKey(source.Name)
+	case TokenFromCookie, TokenFromQuery:
+		if source.Name == "" {
+			source.Name = "token"
+		}
+	case TokenFromWebSocket:
+		if source.Name != "" {
+			return source, fmt.Errorf("websocket token source takes no name")
+		}
+	default:
+		return source, fmt.Errorf("unknown token source %s", source.Kind)
+	}
+
+	return source, nil
+}
+
+// extractToken returns the token of the first source that has one. A query token is
+// removed from the URL and a WebSocket bearer subprotocol from the offered protocols
+// so neither reaches the upstream.
+func extractToken(r *http.Request, sources []TokenSource) (string, TokenSource, error) {
+
+	for _, source := range sources {
+
+		switch source.Kind {
+		case TokenFromHeader:
+			value := r.Header.Get(source.Name)
+
+			if source.Name == "Authorization" {
+				jwtHeader := strings.Split(value, " ")
+				if jwtHeader[0] == "Bearer" && len(jwtHeader) == 2 {
+					return jwtHeader[1], source, nil
+				}
+			} else if value != "" {
+				return strings.TrimPrefix(value, "Bearer "), source, nil
+			}
+		case TokenFromCookie:
+			jwtCookie, err := r.Cookie(source.Name)
+
+			if err == nil && jwtCookie.Value != "" {
+				return jwtCookie.Value, source, nil
+			}
+		case TokenFromQuery:
+			query := r.URL.Query()
+			jwtQuery := query.Get(source.Name)
+
+			if jwtQuery != "" {
+				query.Del(source.Name)
+				r.URL.RawQuery = query.Encode()
+				return jwtQuery, source, nil
+			}
+		case TokenFromWebSocket:
+			if token, ok := extractWebSocketToken(r); ok {
+				return token, source, nil
+			}
+		}
+	}
+
+	return "", TokenSource{}, fmt.Errorf("no token found")
+}
+
+func extractWebSocketToken(r *http.Request) (string, bool) {
+
+	protocols := make([]string, 0)
+	token := ""
+
+	for _, value := range r.Header[webSocketProtocolHeader] {
+		for _, protocol := range strings.Split(value, ",") {
+			protocol = strings.TrimSpace(protocol)
+
+			if strings.HasPrefix(protocol, websocketBearerPrefix) && token == "" {
+				decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(protocol, websocketBearerPrefix))
+				if err == nil && len(decoded) > 0 {
+					token = string(decoded)
+					continue
+				}
+			}
+
+			if protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+
+	if token == "" {
+		return "", false
+	}
+
+	if len(protocols) > 0 {
+		r.Header.Set(webSocketProtocolHeader, strings.Join(protocols, ", "))
+	} else {
+		r.Header.Del(webSocketProtocolHeader)
+	}
+
+	return token, true
+}
+
+// stripCredentials removes the token from every configured source
+func stripCredentials(r *http.Request, sources []TokenSource) {
+
+	for _, source := range sources {
+		switch source.Kind {
+		case TokenFromHeader:
+			r.Header.Del(source.Name)
+		case TokenFromCookie:
+			removeCookie(r, source.Name)
+		case TokenFromQuery:
+			query := r.URL.Query()
+
+			if _, ok := query[source.Name]; ok {
+				query.Del(source.Name)
+				r.URL.RawQuery = query.Encode()
+			}
+		case TokenFromWebSocket:
+			extractWebSocketToken(r)
+		}
+	}
+}
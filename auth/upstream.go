@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+const (
+	CredentialBasic  = "basic"
+	CredentialBearer = "bearer"
+	CredentialHeader = "header"
+	CredentialJWT    = "jwt"
+	// CredentialExchange strips the console token and sends a token signed with the gateway key instead
+	CredentialExchange = "exchange"
+)
+
+const jenkinsAPIBase = "/apis/jenkins.kubesphere.io"
+const jenkinsAPIRedirect = "/job"
+
+const downstreamIssuer = "kubesphere-gateway"
+
+// UpstreamCredential decides how the identity of a request below Path is presented to the upstream
+type UpstreamCredential struct {
+	Path string
+	Kind string
+	// Header and Template of a header credential
+	Header   string
+	Template *template.Template
+	// TTL, Audience and signing secret or gateway keys of a minted jwt or exchange credential
+	TTL      time.Duration
+	Audience string
+	secret   []byte
+	keys     *SigningKeys
+}
+
+// credentialData is the input of header templates, e.g. {{.Username}} or {{index .Claims "email"}}
+type credentialData struct {
+	Username string
+	UID      string
+	Groups   []string
+	Claims   jwt.MapClaims
+	Token    string
+}
+
+// defaultUpstreamCredentials keep passing the console token to Jenkins as basic auth password, a
+// password or an API key is never passed
+func defaultUpstreamCredentials() []*UpstreamCredential {
+	return []*UpstreamCredential{
+		{Path: jenkinsAPIBase, Kind: CredentialBasic},
+		{Path: jenkinsAPIRedirect, Kind: CredentialBasic},
+	}
+}
+
+// NewUpstreamCredential parses the arguments following the path of an upstream_credentials line:
+//
+//	basic
+//	bearer
+//	header <name> <template>
+//	jwt <ttl> <audience> <secret environment variable>
+//	exchange <ttl> <audience>
+func NewUpstreamCredential(path string, args []string) (*UpstreamCredential, error) {
+
+	if len(args) == 0 {
+		return nil, fmt.Errorf("credential kind required")
+	}
+
+	credential := &UpstreamCredential{Path: path, Kind: args[0]}
+
+	switch credential.Kind {
+	case CredentialBasic, CredentialBearer:
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s takes no arguments", credential.Kind)
+		}
+	case CredentialHeader:
+		if len(args) != 3 {
+			return nil, fmt.Errorf("header requires a name and a template")
+		}
+
+		tmpl, err := template.New(args[1]).Option("missingkey=zero").Parse(args[2])
+
+		if err != nil {
+			return nil, err
+		}
+
+		credential.Header = http.CanonicalHeaderKey(args[1])
+		credential.Template = tmpl
+	case CredentialJWT:
+		if len(args) != 4 {
+			return nil, fmt.Errorf("jwt requires a ttl, an audience and a secret environment variable")
+		}
+
+		ttl, err := time.ParseDuration(args[1])
+
+		if err != nil {
+			return nil, err
+		}
+
+		secret := os.Getenv(args[3])
+
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("environment variable %s not set", args[3])
+		}
+
+		credential.TTL = ttl
+		credential.Audience = args[2]
+		credential.secret = []byte(secret)
+	case CredentialExchange:
+		if len(args) != 3 {
+			return nil, fmt.Errorf("exchange requires a ttl and an audience")
+		}
+
+		ttl, err := time.ParseDuration(args[1])
+
+		if err != nil {
+			return nil, err
+		}
+
+		credential.TTL = ttl
+		credential.Audience = args[2]
+	default:
+		return nil, fmt.Errorf("unknown credential kind %s", credential.Kind)
+	}
+
+	return credential, nil
+}
+
+// upstreamCredentialDenied is the error of a request whose identity the matching credential can not present
+type upstreamCredentialDenied struct {
+	reason string
+}
+
+func (e *upstreamCredentialDenied) Error() string {
+	return e.reason
+}
+
+// injectUpstreamCredential applies the first credential whose path matches the request, uToken is
+// empty when the request authenticated with a password or an API key
+func injectUpstreamCredential(credentials []*UpstreamCredential, req *http.Request, uToken string, claims jwt.MapClaims, sources []TokenSource) error {
+
+	for _, credential := range credentials {
+		if httpserver.Path(req.URL.Path).Matches(credential.Path) {
+			return credential.apply(req, uToken, claims, sources)
+		}
+	}
+
+	return nil
+}
+
+func (c *UpstreamCredential) apply(req *http.Request, uToken string, claims jwt.MapClaims, sources []TokenSource) error {
+
+	usr, ok := request.UserFrom(req.Context())
+
+	if !ok {
+		usr = &user.DefaultInfo{}
+	}
+
+	// the token and claims are those of the impersonator, only minted credentials present the impersonated user
+	if _, impersonating := ImpersonatorFrom(req.Context()); impersonating && !c.minted() {
+		return &upstreamCredentialDenied{reason: fmt.Sprintf("the %s credential of %s can not present an impersonated user", c.Kind, c.Path)}
+	}
+
+	// passwords and API keys are not passed upstream
+	if uToken == "" && !c.minted() {
+		return &upstreamCredentialDenied{reason: fmt.Sprintf("the %s credential of %s requires a token, passwords and API keys are not passed upstream", c.Kind, c.Path)}
+	}
+
+	switch c.Kind {
+	case CredentialBasic:
+		req.SetBasicAuth(usr.GetName(), uToken)
+	case CredentialBearer:
+		req.Header.Set("Authorization", "Bearer "+uToken)
+	case CredentialHeader:
+		value := &bytes.Buffer{}
+
+		err := c.Template.Execute(value, credentialData{Username: usr.GetName(), UID: usr.GetUID(), Groups: usr.GetGroups(), Claims: claims, Token: uToken})
+
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set(c.Header, value.String())
+	case CredentialJWT, CredentialExchange:
+		signed, err := c.mint(usr)
+
+		if err != nil {
+			return err
+		}
+
+		if c.Kind == CredentialExchange {
+			stripCredentials(req, sources)
+		}
+
+		req.Header.Set("Authorization", "Bearer "+signed)
+	}
+
+	return nil
+}
+
+// minted credentials are signed by the gateway for the user of the request instead of passing its token
+func (c *UpstreamCredential) minted() bool {
+	return c.Kind == CredentialJWT || c.Kind == CredentialExchange
+}
+
+func (c *UpstreamCredential) mint(usr user.Info) (string, error) {
+
+	now := time.Now()
+
+	claims := jwt.MapClaims{
+		"iss":      downstreamIssuer,
+		"sub":      usr.GetName(),
+		"aud":      c.Audience,
+		"iat":      now.Unix(),
+		"exp":      now.Add(c.TTL).Unix(),
+		"username": usr.GetName(),
+	}
+
+	if usr.GetUID() != "" {
+		claims["uid"] = usr.GetUID()
+	}
+
+	if len(usr.GetGroups()) > 0 {
+		claims["groups"] = usr.GetGroups()
+	}
+
+	if c.keys != nil {
+		return c.keys.sign(claims)
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(c.secret)
+}
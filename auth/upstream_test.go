@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func TestUpstreamCredentialIdentity(t *testing.T) {
+
+	secret := []byte("secret")
+	claims := jwt.MapClaims{"username": "admin", "email": "admin@example.com"}
+
+	tests := []struct {
+		name         string
+		credential   *UpstreamCredential
+		impersonated bool
+		static       bool
+		denied       bool
+		username     string
+	}{
+		{name: "basic", credential: &UpstreamCredential{Path: "/", Kind: CredentialBasic}, username: "admin"},
+		{name: "impersonated basic", credential: &UpstreamCredential{Path: "/", Kind: CredentialBasic}, impersonated: true, denied: true},
+		{name: "impersonated bearer", credential: &UpstreamCredential{Path: "/", Kind: CredentialBearer}, impersonated: true, denied: true},
+		{name: "impersonated header", credential: &UpstreamCredential{Path: "/", Kind: CredentialHeader, Header: "X-Email", Template: template.Must(template.New("email").Parse(`{{index .Claims "email"}}`))}, impersonated: true, denied: true},
+		{name: "password", credential: &UpstreamCredential{Path: "/", Kind: CredentialBasic}, static: true, denied: true},
+		{name: "password header", credential: &UpstreamCredential{Path: "/", Kind: CredentialHeader, Header: "X-Token", Template: template.Must(template.New("token").Parse(`{{.Token}}`))}, static: true, denied: true},
+		{name: "password jwt", credential: &UpstreamCredential{Path: "/", Kind: CredentialJWT, TTL: time.Minute, Audience: "upstream", secret: secret}, static: true, username: "admin"},
+		{name: "impersonated jwt", credential: &UpstreamCredential{Path: "/", Kind: CredentialJWT, TTL: time.Minute, Audience: "upstream", secret: secret}, impersonated: true, username: "alice"},
+	}
+
+	for _, test := range tests {
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+		ctx := request.WithUser(req.Context(), &user.DefaultInfo{Name: "admin"})
+
+		if test.impersonated {
+			ctx = context.WithValue(request.WithUser(ctx, &user.DefaultInfo{Name: "alice"}), impersonatorKey(0), &user.DefaultInfo{Name: "admin"})
+		}
+
+		req = req.WithContext(ctx)
+
+		uToken := "admin-token"
+
+		if test.static {
+			uToken = ""
+		}
+
+		err := injectUpstreamCredential([]*UpstreamCredential{test.credential}, req, uToken, claims, defaultTokenSources())
+
+		if _, denied := err.(*upstreamCredentialDenied); denied != test.denied {
+			t.Errorf("%s: expected denied %v but got %v", test.name, test.denied, err)
+			continue
+		}
+
+		if test.denied {
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		username := ""
+
+		if name, _, ok := req.BasicAuth(); ok {
+			username = name
+		} else if bearer := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "); bearer != "" {
+			token, err := jwt.Parse(bearer, func(*jwt.Token) (interface{}, error) { return secret, nil })
+
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+				continue
+			}
+
+			username, _ = token.Claims.(jwt.MapClaims)["username"].(string)
+		}
+
+		if username != test.username {
+			t.Errorf("%s: expected the credential of %q but got %q", test.name, test.username, username)
+		}
+	}
+}